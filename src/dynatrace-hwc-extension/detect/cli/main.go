@@ -0,0 +1,48 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"dynatrace-hwc-extension/detect"
+	"dynatrace-hwc-extension/redact"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+func main() {
+	// detect only reports its result, the details of the service detection are not shown
+	logger := libbuildpack.NewLogger(redact.NewWriter(ioutil.Discard))
+
+	if len(os.Args) < 2 {
+		logger.Error("Usage: detect <build-dir>")
+		os.Exit(1)
+	}
+
+	d := detect.Detector{
+		BuildDir: os.Args[1],
+		Log:      logger,
+	}
+
+	detected, err := d.Run()
+	if err != nil || !detected {
+		os.Exit(1)
+	}
+
+	os.Stdout.WriteString("dynatrace-hwc-extension\n")
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detect
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"dynatrace-hwc-extension/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+type Detector struct {
+	BuildDir string
+	Log      *libbuildpack.Logger
+}
+
+// Run reports whether the buildpack applies to the app: a .NET Framework app served by HWC that is bound to a Dynatrace service.
+func (d *Detector) Run() (bool, error) {
+	isHWCApp, err := d.isHWCApp()
+	if err != nil || !isHWCApp {
+		return false, err
+	}
+	return supply.ServiceBound(d.Log), nil
+}
+
+// A .NET Framework app pushed for HWC has a Web.config in its root or its compiled assemblies in bin.
+func (d *Detector) isHWCApp() (bool, error) {
+	files, err := ioutil.ReadDir(d.BuildDir)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.EqualFold(file.Name(), "Web.config") {
+			return true, nil
+		}
+	}
+
+	dlls, err := filepath.Glob(filepath.Join(d.BuildDir, "bin", "*.dll"))
+	if err != nil {
+		return false, err
+	}
+	return len(dlls) > 0, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detect_test
+
+import (
+	"bytes"
+	"dynatrace-hwc-extension/detect"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Detect", func() {
+	var (
+		buildDir string
+		detector *detect.Detector
+	)
+
+	BeforeEach(func() {
+		var err error
+		buildDir, err = ioutil.TempDir("", "detect")
+		Expect(err).NotTo(HaveOccurred())
+
+		detector = &detect.Detector{
+			BuildDir: buildDir,
+			Log:      libbuildpack.NewLogger(new(bytes.Buffer)),
+		}
+		os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"dynatrace","credentials":{"environmentid":"abc123","paastoken":"token"}}]}`)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("VCAP_SERVICES")
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+	})
+
+	It("detects an app with a Web.config", func() {
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, "web.config"), []byte("<configuration/>"), 0644)).To(Succeed())
+
+		Expect(detector.Run()).To(BeTrue())
+	})
+
+	It("detects an app with assemblies in bin", func() {
+		Expect(os.MkdirAll(filepath.Join(buildDir, "bin"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, "bin", "App.dll"), []byte{}, 0644)).To(Succeed())
+
+		Expect(detector.Run()).To(BeTrue())
+	})
+
+	It("does not detect other apps", func() {
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, "package.json"), []byte("{}"), 0644)).To(Succeed())
+
+		Expect(detector.Run()).To(BeFalse())
+	})
+
+	It("does not detect an app without a Dynatrace service", func() {
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, "Web.config"), []byte("<configuration/>"), 0644)).To(Succeed())
+		os.Setenv("VCAP_SERVICES", `{}`)
+
+		Expect(detector.Run()).To(BeFalse())
+	})
+})
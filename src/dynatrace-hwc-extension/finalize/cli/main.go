@@ -19,6 +19,7 @@ package main
 import (
 	"dynatrace-hwc-extension/finalize"
 	_ "dynatrace-hwc-extension/hooks"
+	"dynatrace-hwc-extension/redact"
 	"os"
 	"time"
 
@@ -26,7 +27,7 @@ import (
 )
 
 func main() {
-	logger := libbuildpack.NewLogger(os.Stdout)
+	logger := libbuildpack.NewLogger(redact.NewWriter(os.Stdout))
 
 	buildpackDir, err := libbuildpack.GetBuildpackDir()
 	if err != nil {
@@ -60,6 +61,7 @@ func main() {
 	}
 
 	if err := f.Run(); err != nil {
+		logger.Error("Error: %s", err)
 		os.Exit(12)
 	}
 
@@ -17,7 +17,15 @@ limitations under the License.
 package finalize
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dynatrace-hwc-extension/supply"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
@@ -55,10 +63,169 @@ type Finalizer struct {
 	Log      *libbuildpack.Logger
 }
 
+// stagingConfig is the config.yml supply writes to the dependency directory.
+type stagingConfig struct {
+	Config supply.Installation `yaml:"config"`
+}
+
 func (f *Finalizer) Run() error {
 	f.Log.BeginStep("Configuring dynatrace-hwc-extension")
 
-	// TODO: Prepare app for launch here here...
+	var config stagingConfig
+	if err := libbuildpack.NewYAML().Load(filepath.Join(f.Stager.DepDir(), "config.yml"), &config); err != nil && !os.IsNotExist(err) {
+		f.Log.Warning("Unable to read config.yml written by supply: %s", err)
+	}
+	installation := config.Config
+	if !installation.Installed {
+		f.Log.Info("Dynatrace agent is not installed, nothing to validate")
+		return nil
+	}
+
+	// Validate the agent layout so that the app never starts with a broken or missing profiler
+	problems := f.validateInstallation(installation)
+	if len(problems) == 0 {
+		f.Log.Info("Dynatrace agent installation is valid")
+		return nil
+	}
 
+	if !installation.SkipErrors {
+		for _, problem := range problems {
+			f.Log.Error("Invalid Dynatrace agent installation: %s", problem)
+		}
+		return errors.New("the Dynatrace agent installation is incomplete")
+	}
+
+	for _, problem := range problems {
+		f.Log.Warning("Invalid Dynatrace agent installation: %s", problem)
+	}
+	f.Log.Warning("Starting the app without the Dynatrace agent because skiperrors is set")
+	if err := os.Remove(f.profileScript()); err != nil && !os.IsNotExist(err) {
+		f.Log.Error("Unable to remove %s: %s", f.profileScript(), err)
+		return err
+	}
 	return nil
 }
+
+func (f *Finalizer) agentPath() string {
+	return filepath.Join(f.Stager.DepDir(), "dynatrace")
+}
+
+func (f *Finalizer) profileScript() string {
+	return filepath.Join(f.Stager.DepDir(), "profile.d", "dynatrace.bat")
+}
+
+// Returns a description of every problem found in the agent installation described by installation.
+func (f *Finalizer) validateInstallation(installation supply.Installation) []string {
+	var problems []string
+
+	architectures := supply.ConfiguredArchitectures(installation.Bitness)
+	for _, architecture := range architectures {
+		loader := supply.AgentLoaderPath(f.agentPath(), architecture)
+		if !fileExists(loader) {
+			problems = append(problems, fmt.Sprintf("the %s bit profiler %s is missing", architecture, loader))
+		}
+	}
+
+	standaloneConf := filepath.Join(f.agentPath(), "agent", "conf", "standalone.conf")
+	settings, err := readSettings(standaloneConf, func(line string) (string, string) {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) < 2 {
+			return fields[0], ""
+		}
+		return fields[0], strings.TrimSpace(fields[1])
+	})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("unable to read %s: %s", standaloneConf, err))
+	} else {
+		for _, key := range []string{"tenant", "tenanttoken", "server"} {
+			if settings[key] == "" {
+				problems = append(problems, fmt.Sprintf("%s has no %s, the agent would not be able to connect", standaloneConf, key))
+			}
+		}
+	}
+
+	variables, err := readSettings(f.profileScript(), parseSetCommand)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("unable to read %s: %s", f.profileScript(), err))
+		return problems
+	}
+	profilers := 0
+	for name, value := range variables {
+		if !strings.Contains(name, "PROFILER_PATH") {
+			continue
+		}
+		profilers++
+		if path := f.resolveDepsDir(value); !fileExists(path) {
+			problems = append(problems, fmt.Sprintf("%s points to %s, which does not exist", name, value))
+		}
+	}
+	if profilers == 0 {
+		problems = append(problems, fmt.Sprintf("%s does not set any profiler path", f.profileScript()))
+	}
+	for _, architecture := range architectures {
+		if !setsProfilerPath(variables, architecture) {
+			problems = append(problems, fmt.Sprintf("%s does not set the %s bit profiler path", f.profileScript(), architecture))
+		}
+	}
+
+	return problems
+}
+
+// Reports whether variables contain a profiler path of the given architecture, COR_PROFILER_PATH_64 for instance.
+func setsProfilerPath(variables map[string]string, architecture string) bool {
+	for name := range variables {
+		if strings.HasSuffix(name, "PROFILER_PATH_"+architecture) {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps a path of the profile.d script, relative to %DEPS_DIR%, to the dependency directory used during staging.
+func (f *Finalizer) resolveDepsDir(value string) string {
+	value = strings.Replace(value, "%DEPS_DIR%", f.Stager.DepsDir(), 1)
+	return filepath.FromSlash(strings.Replace(value, "\\", "/", -1))
+}
+
+// Parses a line of a batch script of the form set NAME=value or set "NAME=value".
+func parseSetCommand(line string) (string, string) {
+	if len(line) < 4 || !strings.EqualFold(line[:4], "set ") {
+		return "", ""
+	}
+	assignment := strings.TrimSpace(line[4:])
+	if strings.HasPrefix(assignment, `"`) && strings.HasSuffix(assignment, `"`) && len(assignment) > 1 {
+		assignment = assignment[1 : len(assignment)-1]
+	}
+	fields := strings.SplitN(assignment, "=", 2)
+	if len(fields) < 2 {
+		return "", ""
+	}
+	return strings.ToUpper(fields[0]), fields[1]
+}
+
+// Reads the non-empty lines of the file at path into a map, using parse to split each line into a key and a value.
+func readSettings(path string, parse func(string) (string, string)) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if key, value := parse(line); key != "" {
+			settings[key] = value
+		}
+	}
+	return settings, scanner.Err()
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -18,13 +18,132 @@ package finalize_test
 
 //go:generate mockgen -source=finalize.go --destination=mocks_test.go --package=finalize_test
 import (
+	"bytes"
+	"dynatrace-hwc-extension/finalize"
+	"dynatrace-hwc-extension/supply"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// fakeStager implements finalize.Stager on top of temporary directories.
+type fakeStager struct {
+	buildDir string
+	depsDir  string
+	depsIdx  string
+}
+
+func (f *fakeStager) BuildDir() string { return f.buildDir }
+func (f *fakeStager) DepDir() string   { return filepath.Join(f.depsDir, f.depsIdx) }
+func (f *fakeStager) DepsIdx() string  { return f.depsIdx }
+func (f *fakeStager) DepsDir() string  { return f.depsDir }
+
 var _ = Describe("Finalize", func() {
-	It("succeeds", func() {
-		Expect(false).To(Equal(false))
+	var (
+		rootDir   string
+		stager    *fakeStager
+		buffer    *bytes.Buffer
+		finalizer *finalize.Finalizer
+	)
+
+	writeFile := func(path string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	}
+
+	writeConfig := func(installation supply.Installation) {
+		config := map[string]interface{}{"name": "dynatrace-hwc-extension", "config": installation}
+		Expect(libbuildpack.NewYAML().Write(filepath.Join(stager.DepDir(), "config.yml"), config)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		rootDir, err = ioutil.TempDir("", "finalize")
+		Expect(err).NotTo(HaveOccurred())
+
+		stager = &fakeStager{
+			buildDir: filepath.Join(rootDir, "build"),
+			depsDir:  filepath.Join(rootDir, "deps"),
+			depsIdx:  "0",
+		}
+		buffer = new(bytes.Buffer)
+		finalizer = &finalize.Finalizer{
+			Stager: stager,
+			Log:    libbuildpack.NewLogger(buffer),
+		}
+
+		agentDir := filepath.Join(stager.DepDir(), "dynatrace", "agent")
+		writeFile(filepath.Join(agentDir, "lib64", "oneagentloader.dll"), "64")
+		writeFile(filepath.Join(agentDir, "conf", "standalone.conf"), "tenant abc123\ntenanttoken token\nserver https://abc123.live.dynatrace.com/communication")
+		writeFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"),
+			"set \"COR_ENABLE_PROFILING=1\"\r\nset \"COR_PROFILER_PATH_64=%DEPS_DIR%\\0\\dynatrace\\agent\\lib64\\oneagentloader.dll\"\r\n")
+		writeConfig(supply.Installation{Installed: true, Bitness: "64", Architectures: []string{"64"}})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(rootDir)).To(Succeed())
+	})
+
+	It("succeeds when no agent was installed", func() {
+		writeConfig(supply.Installation{})
+
+		Expect(finalizer.Run()).To(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("Dynatrace agent is not installed"))
+	})
+
+	It("accepts a complete installation", func() {
+		Expect(finalizer.Run()).To(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("Dynatrace agent installation is valid"))
+	})
+
+	It("reports a missing profiler of a configured architecture", func() {
+		writeConfig(supply.Installation{Installed: true, Bitness: "all", Architectures: []string{"64"}})
+
+		Expect(finalizer.Run()).NotTo(Succeed())
+		Expect(buffer.String()).To(MatchRegexp("the 32 bit profiler .*lib.oneagentloader.dll is missing"))
+		Expect(buffer.String()).To(ContainSubstring("does not set the 32 bit profiler path"))
+	})
+
+	It("reports a package without the profiler of the configured bitness", func() {
+		agentDir := filepath.Join(stager.DepDir(), "dynatrace", "agent")
+		Expect(os.RemoveAll(filepath.Join(agentDir, "lib64"))).To(Succeed())
+		writeFile(filepath.Join(agentDir, "lib", "oneagentloader.dll"), "32")
+		writeFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"),
+			"set \"COR_ENABLE_PROFILING=1\"\r\nset \"COR_PROFILER_PATH_32=%DEPS_DIR%\\0\\dynatrace\\agent\\lib\\oneagentloader.dll\"\r\n")
+		writeConfig(supply.Installation{Installed: true, Bitness: "64", Architectures: []string{"32"}})
+
+		Expect(finalizer.Run()).NotTo(Succeed())
+		Expect(buffer.String()).To(MatchRegexp("the 64 bit profiler .*lib64.oneagentloader.dll is missing"))
+		Expect(buffer.String()).To(ContainSubstring("does not set the 64 bit profiler path"))
+	})
+
+	It("reports an incomplete standalone.conf", func() {
+		writeFile(filepath.Join(stager.DepDir(), "dynatrace", "agent", "conf", "standalone.conf"), "tenant abc123\ntenanttoken \nserver ")
+
+		Expect(finalizer.Run()).NotTo(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("has no tenanttoken"))
+		Expect(buffer.String()).To(ContainSubstring("has no server"))
+	})
+
+	It("reports a profiler path of dynatrace.bat that does not exist", func() {
+		writeFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"),
+			"set \"COR_PROFILER_PATH_64=%DEPS_DIR%\\1\\dynatrace\\agent\\lib64\\oneagentloader.dll\"\r\n")
+
+		Expect(finalizer.Run()).NotTo(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("COR_PROFILER_PATH_64 points to %DEPS_DIR%\\1\\dynatrace"))
+	})
+
+	Context("skiperrors is set", func() {
+		It("warns and starts the app without the agent", func() {
+			writeConfig(supply.Installation{Installed: true, SkipErrors: true, Bitness: "32", Architectures: []string{"32"}})
+
+			Expect(finalizer.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Starting the app without the Dynatrace agent"))
+			Expect(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat")).NotTo(BeAnExistingFile())
+		})
 	})
-	// TODO: Add tests here to check configure dependency functions work
 })
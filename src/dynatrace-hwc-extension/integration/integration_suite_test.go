@@ -24,6 +24,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/blang/semver"
@@ -50,7 +51,7 @@ func init() {
 var _ = SynchronizedBeforeSuite(func() []byte {
 	// Run once
 	if buildpackVersion == "" {
-		packagedBuildpack, err := cutlass.PackageUniquelyVersionedBuildpack("") // "" denotes any stack. Use specific stack (e.g. "cflinuxfs2" if desired)
+		packagedBuildpack, err := cutlass.PackageUniquelyVersionedBuildpack("", ApiHasStackAssociation()) // "" denotes any stack. Use specific stack (e.g. "cflinuxfs2" if desired)
 		Expect(err).NotTo(HaveOccurred())
 
 		data, err := json.Marshal(packagedBuildpack)
@@ -116,6 +117,31 @@ func ApiHasTask() bool {
 func ApiHasMultiBuildpack() bool {
 	return ApiGreaterThan("2.90.0")
 }
+func ApiHasStackAssociation() bool {
+	return ApiGreaterThan("2.113.0")
+}
+
+// dynatraceServiceEnv returns a VCAP_SERVICES binding for the Dynatrace environment given by DT_ENVIRONMENT_ID and DT_PAAS_TOKEN,
+// the staging tests that need to download the agent are skipped without them. The JSON is single quoted because
+// cutlass.InternetTraffic writes it to an ENV instruction of a Dockerfile, which would otherwise strip its double quotes.
+func dynatraceServiceEnv() string {
+	environmentID, paasToken := os.Getenv("DT_ENVIRONMENT_ID"), os.Getenv("DT_PAAS_TOKEN")
+	if environmentID == "" || paasToken == "" {
+		Skip("DT_ENVIRONMENT_ID and DT_PAAS_TOKEN are required to download the agent")
+	}
+
+	services, err := json.Marshal(map[string][]map[string]interface{}{
+		"user-provided": {{
+			"name": "dynatrace",
+			"credentials": map[string]string{
+				"environmentid": environmentID,
+				"paastoken":     paasToken,
+			},
+		}},
+	})
+	Expect(err).To(BeNil())
+	return "VCAP_SERVICES='" + strings.Replace(string(services), "'", `'\''`, -1) + "'"
+}
 
 func AssertUsesProxyDuringStagingIfPresent(fixtureName string) {
 	Context("with an uncached buildpack", func() {
@@ -126,6 +152,8 @@ func AssertUsesProxyDuringStagingIfPresent(fixtureName string) {
 		})
 
 		It("uses a proxy during staging if present", func() {
+			serviceEnv := dynatraceServiceEnv()
+
 			proxy, err := cutlass.NewProxy()
 			Expect(err).To(BeNil())
 			defer proxy.Close()
@@ -136,11 +164,10 @@ func AssertUsesProxyDuringStagingIfPresent(fixtureName string) {
 			Expect(err).To(BeNil())
 			defer os.Remove(bpFile)
 
-			traffic, built, err := cutlass.InternetTraffic(
-				bpDir,
-				filepath.Join("fixtures", fixtureName),
+			traffic, built, _, err := cutlass.InternetTraffic(
+				filepath.Join(bpDir, "fixtures", fixtureName),
 				bpFile,
-				[]string{"HTTP_PROXY=" + proxy.URL, "HTTPS_PROXY=" + proxy.URL},
+				[]string{"HTTP_PROXY=" + proxy.URL, "HTTPS_PROXY=" + proxy.URL, serviceEnv},
 			)
 			Expect(err).To(BeNil())
 			Expect(built).To(BeTrue())
@@ -167,9 +194,8 @@ func AssertNoInternetTraffic(fixtureName string) {
 		Expect(err).To(BeNil())
 		defer os.Remove(bpFile)
 
-		traffic, built, err := cutlass.InternetTraffic(
-			bpDir,
-			filepath.Join("fixtures", fixtureName),
+		traffic, built, _, err := cutlass.InternetTraffic(
+			filepath.Join(bpDir, "fixtures", fixtureName),
 			bpFile,
 			[]string{},
 		)
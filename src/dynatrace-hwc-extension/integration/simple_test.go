@@ -41,4 +41,6 @@ var _ = Describe("Simple Integration Test", func() {
 		PushAppAndConfirm(app)
 		Expect(app.GetBody("/")).To(ContainSubstring("Something on your website"))
 	})
+
+	AssertUsesProxyDuringStagingIfPresent("simple_test")
 })
@@ -0,0 +1,134 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redact keeps Dynatrace tokens and other credentials out of the staging output.
+package redact
+
+import (
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Mask replaces every redacted value.
+const Mask = "****"
+
+// Api-Token values in query strings (Api-Token=...) and in Authorization headers (Api-Token ...).
+var apiTokenPattern = regexp.MustCompile(`(?i)(Api-Token[=\s]\s*)[^&\s"']+`)
+
+// Writer masks the registered secrets and any Api-Token value in everything written to the underlying writer. It is meant
+// to be passed to libbuildpack.NewLogger so that every log line goes through it.
+type Writer struct {
+	w       io.Writer
+	mu      sync.Mutex
+	secrets []string
+}
+
+// NewWriter returns a Writer that writes the redacted output to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Add registers values that must never show up in the output. Empty values are ignored.
+func (r *Writer) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+}
+
+// String returns s with the registered secrets and Api-Token values masked.
+func (r *Writer) String(s string) string {
+	r.mu.Lock()
+	secrets := r.secrets
+	r.mu.Unlock()
+
+	for _, secret := range secrets {
+		s = replaceToken(s, secret)
+	}
+	return apiTokenPattern.ReplaceAllString(s, "${1}"+Mask)
+}
+
+// Masks the occurrences of secret in s that are whole tokens, i.e. not preceded or followed by another letter or digit.
+// A short secret would otherwise mask parts of unrelated words, such as every p of https.
+func replaceToken(s string, secret string) string {
+	var result strings.Builder
+	for {
+		i := strings.Index(s, secret)
+		if i < 0 {
+			result.WriteString(s)
+			return result.String()
+		}
+		end := i + len(secret)
+		if continuesToken(s[:i], secret, false) || continuesToken(s[end:], secret, true) {
+			result.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		result.WriteString(s[:i])
+		result.WriteString(Mask)
+		s = s[end:]
+	}
+}
+
+// Reports whether the text next to secret continues the word secret starts (before) or ends (after) with.
+func continuesToken(text string, secret string, after bool) bool {
+	if text == "" {
+		return false
+	}
+	if after {
+		last, _ := utf8.DecodeLastRuneInString(secret)
+		next, _ := utf8.DecodeRuneInString(text)
+		return isWordRune(last) && isWordRune(next)
+	}
+	first, _ := utf8.DecodeRuneInString(secret)
+	previous, _ := utf8.DecodeLastRuneInString(text)
+	return isWordRune(first) && isWordRune(previous)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Write redacts p and writes it to the underlying writer. It reports len(p) as written so that callers don't treat the
+// shorter redacted output as a short write.
+func (r *Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// URL returns rawURL without the user info, the query and the fragment, which may carry credentials. A URL that can't be
+// parsed is masked completely.
+func URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Mask
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	return u.String()
+}
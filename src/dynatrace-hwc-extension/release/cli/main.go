@@ -0,0 +1,40 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"dynatrace-hwc-extension/release"
+	"os"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(os.Stderr)
+
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		logger.Error("Unable to determine buildpack directory: %s", err.Error())
+		os.Exit(9)
+	}
+
+	r := release.Releaser{BuildpackDir: buildpackDir}
+	if err := r.Run(os.Stdout); err != nil {
+		logger.Error("Unable to write release metadata: %s", err.Error())
+		os.Exit(10)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultWebProcess starts the app with the hwc.exe supplied by the HWC buildpack, as the Procfile bundled with the buildpack does
+const defaultWebProcess = `.cloudfoundry\hwc.exe`
+
+type Releaser struct {
+	BuildpackDir string
+}
+
+// Run writes the release metadata with the default web process to w.
+func (r *Releaser) Run(w io.Writer) error {
+	release := map[string]map[string]string{
+		"default_process_types": {"web": r.webProcess()},
+	}
+	data, err := yaml.Marshal(release)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "---\n"+string(data))
+	return err
+}
+
+// Returns the web process of the Procfile bundled with the buildpack, so that both always agree.
+func (r *Releaser) webProcess() string {
+	procfile, err := os.Open(filepath.Join(r.BuildpackDir, "Procfile"))
+	if err != nil {
+		return defaultWebProcess
+	}
+	defer procfile.Close()
+
+	scanner := bufio.NewScanner(procfile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "web:") {
+			if command := strings.TrimSpace(strings.TrimPrefix(line, "web:")); command != "" {
+				return command
+			}
+		}
+	}
+	return defaultWebProcess
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release_test
+
+import (
+	"bytes"
+	"dynatrace-hwc-extension/release"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Release", func() {
+	var buildpackDir string
+
+	BeforeEach(func() {
+		var err error
+		buildpackDir, err = ioutil.TempDir("", "release")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildpackDir)).To(Succeed())
+	})
+
+	It("uses hwc.exe as the default web process", func() {
+		output := new(bytes.Buffer)
+		Expect((&release.Releaser{BuildpackDir: buildpackDir}).Run(output)).To(Succeed())
+
+		Expect(output.String()).To(Equal("---\ndefault_process_types:\n  web: .cloudfoundry\\hwc.exe\n"))
+	})
+
+	It("uses the web process of the bundled Procfile", func() {
+		Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "Procfile"), []byte("web: .cloudfoundry\\hwc.exe -port 8080\n"), 0644)).To(Succeed())
+
+		output := new(bytes.Buffer)
+		Expect((&release.Releaser{BuildpackDir: buildpackDir}).Run(output)).To(Succeed())
+
+		Expect(output.String()).To(ContainSubstring("web: .cloudfoundry\\hwc.exe -port 8080\n"))
+	})
+})
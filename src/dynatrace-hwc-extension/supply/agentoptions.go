@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dynatrace-hwc-extension/redact"
+)
+
+// values of options with these names are masked in the staging log
+var secretAgentOptionPattern = regexp.MustCompile(`(?i)token|password|secret|key`)
+
+// Checks the agent options of creds before they are written to dynatrace.bat. Only DT_ settings of the agent are exported,
+// other names could replace the environment of the app or DEPS_DIR, which locates the profiler. The variables the buildpack
+// writes itself can't be overridden either, the agent would otherwise lose the values the buildpack merged, such as the
+// default blocklist or the Cloud Foundry tags.
+func validateAgentOptions(creds *credentials) error {
+	options := creds.AgentOptions
+	managed := map[string]string{}
+	for _, variable := range buildpackAgentVariables(creds) {
+		managed[variable.Name] = variable.Setting
+	}
+
+	for _, name := range sortedKeys(options) {
+		if !batchVariablePattern.MatchString(name) {
+			return fmt.Errorf("invalid agent option name %q, only letters, digits and _ are allowed", name)
+		}
+		upper := strings.ToUpper(name)
+		if !strings.HasPrefix(upper, "DT_") {
+			return fmt.Errorf("agent option %s is not a Dynatrace agent setting, only names starting with DT_ are allowed", name)
+		}
+		if setting, ok := managed[upper]; ok {
+			return fmt.Errorf("agent option %s is set by the buildpack, use %s instead", name, setting)
+		}
+		if strings.ContainsAny(options[name], "\r\n") {
+			return fmt.Errorf("the value of agent option %s must not contain line breaks", name)
+		}
+	}
+	return nil
+}
+
+// Logs the agent options, the values of the options that look like secrets are redacted.
+func logAgentOptions(s *Supplier, options map[string]string) {
+	writer, _ := s.Log.Output().(*redact.Writer)
+	for _, name := range sortedKeys(options) {
+		value := options[name]
+		if secretAgentOptionPattern.MatchString(name) {
+			if writer == nil {
+				value = "****"
+			} else {
+				writer.Add(value)
+			}
+		}
+		s.Log.Info("Setting agent option %s=%s", name, value)
+	}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
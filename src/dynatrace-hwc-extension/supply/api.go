@@ -0,0 +1,176 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const apiRequestTimeout = 30 * time.Second
+
+// valid agent versions look like 1.195.161.20200615-111543, prefixes such as 1.195 are accepted as well
+var agentVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,3}(-[0-9]+)?$`)
+
+// Returns the base URL of the Dynatrace API, either the apiurl of the credentials or the SaaS URL of the environment.
+func apiBaseURL(c *credentials) string {
+	if c.APIURL != "" {
+		return c.APIURL
+	}
+	return fmt.Sprintf("https://%s.live.dynatrace.com/api", c.EnvironmentID)
+}
+
+// Sends a GET request authenticated with the PaaS token to the Dynatrace API and decodes the JSON response into out.
+func getFromAPI(s *Supplier, creds *credentials, apiURL string, out interface{}) error {
+	return callAPI(s, creds, http.MethodGet, apiURL, creds.PaasToken, nil, out)
+}
+
+// Sends a request authenticated with token to the Dynatrace API. The body, when not nil, is sent as JSON and the JSON
+// response is decoded into out.
+func callAPI(s *Supplier, creds *credentials, method string, apiURL string, token string, body interface{}, out interface{}) error {
+	httpClient, err := newHTTPClient(s, creds, apiRequestTimeout)
+	if err != nil {
+		return err
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, apiURL, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Api-Token "+token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if isCertificateError(err) {
+			return certificateError(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newDownloadError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Resolves the agent version to install. Without agentversion the latest version is installed, it is looked up so that the
+// package is cached by its version. A pinned version is checked against the versions available in the environment, a
+// prefix like 1.195 resolves to the newest matching version.
+func resolveAgentVersion(s *Supplier, creds *credentials) (string, error) {
+	if creds.CustomOneAgentURL != "" {
+		if creds.AgentVersion != "" && creds.AgentVersion != "latest" {
+			s.Log.Warning("Ignoring agentversion %s, the agent is downloaded from customoneagenturl", creds.AgentVersion)
+		}
+		return "latest", nil
+	}
+	if creds.AgentVersion == "" || creds.AgentVersion == "latest" {
+		return resolveLatestAgentVersion(s, creds), nil
+	}
+	if !agentVersionPattern.MatchString(creds.AgentVersion) {
+		return "", fmt.Errorf("invalid agentversion %s, expected a version like 1.195.161.20200615-111543", creds.AgentVersion)
+	}
+
+	var versions struct {
+		AvailableVersions []string `json:"availableVersions"`
+	}
+	versionsURL := apiBaseURL(creds) + "/v1/deployment/installer/agent/versions/windows/paas"
+	if err := getFromAPI(s, creds, versionsURL, &versions); err != nil {
+		return "", fmt.Errorf("unable to list the available agent versions: %s", err)
+	}
+
+	resolved := ""
+	for _, version := range versions.AvailableVersions {
+		if version != creds.AgentVersion && !strings.HasPrefix(version, creds.AgentVersion+".") {
+			continue
+		}
+		if resolved == "" || compareAgentVersions(version, resolved) > 0 {
+			resolved = version
+		}
+	}
+	if resolved == "" {
+		return "", errors.New("agentversion " + creds.AgentVersion + " is not available in the Dynatrace environment")
+	}
+
+	s.Log.Info("Pinned agent version %s resolved to %s", creds.AgentVersion, resolved)
+	return resolved, nil
+}
+
+// Looks up the version of the latest agent. When the lookup fails, e.g. because of an older cluster, "latest" is returned and
+// the cached package is revalidated with a conditional request instead.
+func resolveLatestAgentVersion(s *Supplier, creds *credentials) string {
+	var metainfo struct {
+		LatestAgentVersion string `json:"latestAgentVersion"`
+	}
+	metainfoURL := apiBaseURL(creds) + "/v1/deployment/installer/agent/windows/paas/latest/metainfo"
+	err := getFromAPI(s, creds, metainfoURL, &metainfo)
+	if err == nil && !agentVersionPattern.MatchString(metainfo.LatestAgentVersion) {
+		err = fmt.Errorf("unexpected version %q", metainfo.LatestAgentVersion)
+	}
+	if err != nil {
+		s.Log.Info("Unable to look up the latest agent version, continuing with latest: %s", err)
+		return "latest"
+	}
+
+	s.Log.Info("Latest agent version resolved to %s", metainfo.LatestAgentVersion)
+	return metainfo.LatestAgentVersion
+}
+
+// Compares two agent versions component by component, returning a negative number, zero or a positive number.
+func compareAgentVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' })
+	}
+	partsA, partsB := split(a), split(b)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		if len(partsA[i]) != len(partsB[i]) {
+			return len(partsA[i]) - len(partsB[i])
+		}
+		if c := strings.Compare(partsA[i], partsB[i]); c != 0 {
+			return c
+		}
+	}
+	return len(partsA) - len(partsB)
+}
+
+// Returns the path of the deployment API for the given agent version.
+func agentVersionPath(version string) string {
+	if version == "" || version == "latest" {
+		return "latest"
+	}
+	return "version/" + url.PathEscape(version)
+}
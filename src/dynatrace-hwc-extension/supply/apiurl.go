@@ -0,0 +1,115 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SaaS environments serve their API at https://<environmentid>.live.dynatrace.com/api
+var saasDomains = []string{".dynatrace.com", ".dynatracelabs.com"}
+
+// Replaces the apiurl of the credentials with its normalized form, see normalizedAPIURL. An apiurl of Dynatrace Managed
+// or an ActiveGate that still doesn't name the environment is kept, but may end in a 404.
+func normalizeAPIURL(s *Supplier, creds *credentials) error {
+	if creds.APIURL == "" {
+		return nil
+	}
+
+	name := credentialName(creds, "apiurl")
+	normalized, err := normalizedAPIURL(creds.APIURL, creds.EnvironmentID)
+	if err != nil {
+		return fmt.Errorf("invalid %s %s: %s", name, creds.APIURL, err)
+	}
+	if normalized != creds.APIURL {
+		s.Log.Info("Using %s %s instead of %s", name, normalized, creds.APIURL)
+		creds.APIURL = normalized
+	}
+	if isManagedURLWithoutEnvironment(normalized) {
+		s.Log.Warning("%s %s does not name the environment, Dynatrace Managed and ActiveGates expect https://<host>/e/<environmentid>/api", name, normalized)
+	}
+	return nil
+}
+
+// Returns the API URL apiURL is meant to be: https is assumed without a scheme, a trailing slash or a pasted endpoint after
+// /api are dropped and a missing /api is added. SaaS URLs end in /api, Managed and ActiveGate URLs in /e/<environmentid>/api,
+// the environment is taken from environmentID when the URL doesn't name it.
+func normalizedAPIURL(apiURL string, environmentID string) (string, error) {
+	raw := strings.TrimSpace(apiURL)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return "", errors.New("expected https://<environmentid>.live.dynatrace.com/api or https://<host>/e/<environmentid>/api")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("unsupported scheme %s, expected https", u.Scheme)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("the URL must not contain a user, a query or a fragment")
+	}
+
+	segments := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	urlEnvironment := ""
+	for i, segment := range segments {
+		if segment == "e" {
+			if i+1 == len(segments) || segments[i+1] == "api" {
+				return "", errors.New("the environment is missing after /e/")
+			}
+			urlEnvironment = segments[i+1]
+			segments = segments[:i+2]
+			break
+		}
+		if segment == "api" {
+			segments = segments[:i]
+			break
+		}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case isSaaSHost(host) && urlEnvironment == "":
+		urlEnvironment = host[:strings.Index(host, ".")]
+		segments = nil
+	case urlEnvironment == "" && environmentID != "":
+		segments = append(segments, "e", environmentID)
+		urlEnvironment = environmentID
+	}
+	if environmentID != "" && urlEnvironment != "" && !strings.EqualFold(urlEnvironment, environmentID) {
+		return "", fmt.Errorf("it belongs to the environment %s, not to %s", urlEnvironment, environmentID)
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	u.Path = "/" + strings.Join(append(segments, "api"), "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// Reports whether host belongs to Dynatrace SaaS, where the environment is the first label of the host name.
+func isSaaSHost(host string) bool {
+	for _, domain := range saasDomains {
+		if strings.HasSuffix(host, domain) {
+			return true
+		}
+	}
+	return false
+}
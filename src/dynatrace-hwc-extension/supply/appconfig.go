@@ -0,0 +1,236 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	appConfigFile       = "dynatrace.yml"
+	buildpackConfigFile = "buildpack.yml"
+)
+
+// appConfig holds the per-app options of dynatrace.yml, or of the dynatrace section of buildpack.yml. They take precedence
+// over the Dynatrace service credentials and the DT_* environment variables.
+type appConfig struct {
+	Disabled         bool              `yaml:"disabled"`
+	AgentVersion     string            `yaml:"agentversion"`
+	AgentSha256      string            `yaml:"agentsha256"`
+	Bitness          string            `yaml:"bitness"`
+	Blocklist        []string          `yaml:"blocklist"`
+	BlocklistMode    string            `yaml:"blocklistmode"`
+	HostGroup        string            `yaml:"hostgroup"`
+	Tags             []string          `yaml:"tags"`
+	CustomProperties map[string]string `yaml:"customproperties"`
+	LogLevelCon      string            `yaml:"loglevelcon"`
+	LogLevelFile     string            `yaml:"loglevelfile"`
+	// templates of the Cloud Foundry metadata, see cfmetadata.go
+	CFMetadata         *bool             `yaml:"cfmetadata"`
+	CFTags             []string          `yaml:"cftags"`
+	CFCustomProperties map[string]string `yaml:"cfcustomproperties"`
+	CFHostGroup        string            `yaml:"cfhostgroup"`
+	// release metadata, see release.go
+	ReleaseVersion      string `yaml:"releaseversion"`
+	ReleaseStage        string `yaml:"releasestage"`
+	ReleaseProduct      string `yaml:"releaseproduct"`
+	ReleaseBuildVersion string `yaml:"releasebuildversion"`
+	DeploymentEvent     *bool  `yaml:"deploymentevent"`
+
+	source string
+}
+
+// keys of appConfig, anything else in the file is reported as unknown
+var appConfigKeys = []string{
+	"disabled", "agentversion", "agentsha256", "bitness", "blocklist", "blocklistmode", "hostgroup", "tags", "customproperties",
+	"loglevelcon", "loglevelfile", "cfmetadata", "cftags", "cfcustomproperties", "cfhostgroup", "releaseversion", "releasestage",
+	"releaseproduct", "releasebuildversion", "deploymentevent",
+}
+
+// log levels of the agent
+var agentLogLevels = map[string]bool{"none": true, "severe": true, "warning": true, "info": true, "debug": true}
+
+// Dynatrace host groups may only contain these characters and must not start with dt.
+var hostGroupPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,100}$`)
+
+// tags and custom properties are passed as space separated lists to the agent
+var agentPropertyPattern = regexp.MustCompile(`^[^\s=]+$`)
+
+// Loads the app configuration from the build directory. dynatrace.yml takes precedence over the dynatrace section of
+// buildpack.yml, an app without either gets an empty configuration.
+func loadAppConfig(s *Supplier) (*appConfig, error) {
+	content, source, err := readAppConfig(s)
+	if err != nil || content == nil {
+		return &appConfig{}, err
+	}
+
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", source, err)
+	}
+	if unknown := unknownAppConfigKeys(keys); len(unknown) > 0 {
+		s.Log.Warning("Ignoring unknown keys in %s: %s (supported keys are %s)", source, strings.Join(unknown, ", "),
+			strings.Join(appConfigKeys, ", "))
+	}
+
+	config := &appConfig{source: source}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", source, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", source, err)
+	}
+	s.Log.Info("Loaded the Dynatrace configuration of the app from %s", source)
+	return config, nil
+}
+
+// Returns the raw configuration and the name of the file it was read from, or nil when the app has none.
+func readAppConfig(s *Supplier) ([]byte, string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), appConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+
+	var buildpackConfig struct {
+		Dynatrace interface{} `yaml:"dynatrace"`
+	}
+	buildpackContent, bpErr := ioutil.ReadFile(filepath.Join(s.Stager.BuildDir(), buildpackConfigFile))
+	if bpErr != nil && !os.IsNotExist(bpErr) {
+		return nil, "", bpErr
+	}
+	if bpErr == nil {
+		if err := yaml.Unmarshal(buildpackContent, &buildpackConfig); err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %s", buildpackConfigFile, err)
+		}
+	}
+
+	if content != nil {
+		if buildpackConfig.Dynatrace != nil {
+			s.Log.Warning("Ignoring the dynatrace section of %s, %s takes precedence", buildpackConfigFile, appConfigFile)
+		}
+		return content, appConfigFile, nil
+	}
+	if buildpackConfig.Dynatrace == nil {
+		return nil, "", nil
+	}
+	section, err := yaml.Marshal(buildpackConfig.Dynatrace)
+	if err != nil {
+		return nil, "", err
+	}
+	return section, buildpackConfigFile, nil
+}
+
+func unknownAppConfigKeys(keys map[string]interface{}) []string {
+	known := make(map[string]bool, len(appConfigKeys))
+	for _, key := range appConfigKeys {
+		known[key] = true
+	}
+
+	var unknown []string
+	for key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Checks the values that end up in the environment and the configuration of the agent.
+func (c *appConfig) validate() error {
+	for _, pattern := range c.Blocklist {
+		if strings.TrimSpace(pattern) == "" || strings.ContainsAny(pattern, ";,") {
+			return fmt.Errorf("blocklist pattern %q must not be empty or contain ; or ,", pattern)
+		}
+	}
+	if c.HostGroup != "" && (!hostGroupPattern.MatchString(c.HostGroup) || strings.HasPrefix(strings.ToLower(c.HostGroup), "dt.")) {
+		return fmt.Errorf("hostgroup %q may only contain letters, digits, ., - and _ and must not start with dt.", c.HostGroup)
+	}
+	for _, tag := range c.Tags {
+		if strings.ContainsAny(tag, " \t") || tag == "" {
+			return fmt.Errorf("tag %q must not be empty or contain spaces", tag)
+		}
+	}
+	for key, value := range c.CustomProperties {
+		if !agentPropertyPattern.MatchString(key) || strings.ContainsAny(value, " \t") || value == "" {
+			return fmt.Errorf("custom property %s=%s must not be empty or contain spaces, and its key no =", key, value)
+		}
+	}
+	for name, level := range map[string]string{"loglevelcon": c.LogLevelCon, "loglevelfile": c.LogLevelFile} {
+		if level != "" && !agentLogLevels[strings.ToLower(level)] {
+			return fmt.Errorf("%s %s is not one of none, severe, warning, info or debug", name, level)
+		}
+	}
+	return nil
+}
+
+// Merges the app configuration over the credentials. Each setting the app overrides is logged, so that the staging log shows
+// where the effective value comes from.
+func (c *appConfig) applyTo(s *Supplier, creds *credentials) {
+	override := func(key string, target *string, value string) {
+		if value == "" {
+			return
+		}
+		if *target != "" && *target != value {
+			s.Log.Info("Using %s %s from %s instead of %s from %s", key, value, c.source, *target, creds.ServiceName)
+		}
+		*target = value
+	}
+	// the checksum of the service belongs to its agentversion, it can't verify another version the app pins
+	if c.AgentVersion != "" && c.AgentVersion != creds.AgentVersion && c.AgentSha256 == "" && creds.AgentSha256 != "" {
+		s.Log.Warning("Ignoring agentsha256 from %s, it does not belong to agentversion %s from %s", creds.ServiceName, c.AgentVersion, c.source)
+		creds.AgentSha256 = ""
+	}
+	override("agentversion", &creds.AgentVersion, c.AgentVersion)
+	override("agentsha256", &creds.AgentSha256, c.AgentSha256)
+	override("bitness", &creds.Bitness, c.Bitness)
+	override("blocklistmode", &creds.BlocklistMode, c.BlocklistMode)
+	if c.Blocklist != nil {
+		if len(creds.Blocklist) > 0 {
+			s.Log.Info("Using blocklist from %s instead of the one from %s", c.source, creds.ServiceName)
+		}
+		creds.Blocklist = c.Blocklist
+	}
+
+	if c.DeploymentEvent != nil {
+		creds.DeploymentEvent = *c.DeploymentEvent
+	}
+
+	creds.HostGroup = c.HostGroup
+	creds.Tags = c.Tags
+	creds.CustomProperties = c.CustomProperties
+	creds.LogLevelCon = strings.ToLower(c.LogLevelCon)
+	creds.LogLevelFile = strings.ToLower(c.LogLevelFile)
+}
+
+// Returns the custom properties in the key=value format of DT_CUSTOM_PROP, sorted by key.
+func customPropertiesValue(properties map[string]string) string {
+	pairs := make([]string, 0, len(properties))
+	for key, value := range properties {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// names cmd.exe accepts for environment variables without quoting
+var batchVariablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// characters cmd.exe interprets outside of double quotes
+const batchSpecialCharacters = "^&|<>()"
+
+// batchScript builds the set commands of a cmd.exe batch file, like the profile.d scripts. Values are escaped so that they
+// are assigned literally whatever characters they contain. The first invalid command is reported by Script.
+type batchScript struct {
+	lines []string
+	err   error
+}
+
+// Set adds a command that assigns value to the variable name.
+func (b *batchScript) Set(name string, value string) {
+	b.set(name, "", value)
+}
+
+// SetReference adds a command that assigns the value of the variable reference, expanded when the script runs, followed by
+// suffix to the variable name.
+func (b *batchScript) SetReference(name string, reference string, suffix string) {
+	if !batchVariablePattern.MatchString(reference) {
+		b.fail(fmt.Errorf("invalid variable reference %q", reference))
+		return
+	}
+	b.set(name, "%"+reference+"%", suffix)
+}
+
+// Script returns the batch file with CRLF line endings.
+func (b *batchScript) Script() (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	if len(b.lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(b.lines, "\r\n") + "\r\n", nil
+}
+
+func (b *batchScript) set(name string, prefix string, value string) {
+	if !batchVariablePattern.MatchString(name) {
+		b.fail(fmt.Errorf("invalid variable name %q", name))
+		return
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		b.fail(fmt.Errorf("the value of %s must not contain line breaks", name))
+		return
+	}
+	b.lines = append(b.lines, `set "`+name+"="+prefix+escapeBatchValue(value)+`"`)
+}
+
+func (b *batchScript) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Escapes a value for the quoted form of the set command. % is expanded even between double quotes and is always doubled.
+// Every double quote of the value toggles the quoting of cmd.exe, the special characters that end up outside of the quotes
+// are escaped with ^. set keeps everything up to the last double quote, so the quotes of the value are assigned as well.
+func escapeBatchValue(value string) string {
+	var escaped strings.Builder
+	quoted := true
+	for _, r := range value {
+		switch {
+		case r == '%':
+			escaped.WriteString("%%")
+			continue
+		case r == '"':
+			quoted = !quoted
+		case !quoted && strings.ContainsRune(batchSpecialCharacters, r):
+			escaped.WriteRune('^')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
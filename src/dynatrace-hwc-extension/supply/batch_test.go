@@ -0,0 +1,70 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("batchScript", func() {
+	DescribeTable("escapes values for cmd.exe",
+		func(value string, expected string) {
+			var script batchScript
+			script.Set("DT_VALUE", value)
+
+			Expect(script.Script()).To(Equal(expected))
+		},
+		Entry("plain value", "zone-1", "set \"DT_VALUE=zone-1\"\r\n"),
+		Entry("empty value", "", "set \"DT_VALUE=\"\r\n"),
+		Entry("spaces", "team=payments frontend ", "set \"DT_VALUE=team=payments frontend \"\r\n"),
+		Entry("special characters between the quotes", "a&b|c<d>e^f(g)", "set \"DT_VALUE=a&b|c<d>e^f(g)\"\r\n"),
+		Entry("variable references", "%PATH%;50%", "set \"DT_VALUE=%%PATH%%;50%%\"\r\n"),
+		Entry("a quote followed by a command", "a\"&calc&\"b", "set \"DT_VALUE=a\"^&calc^&\"b\"\r\n"),
+		Entry("an unbalanced quote", "a\"|b>c", "set \"DT_VALUE=a\"^|b^>c\"\r\n"),
+	)
+
+	It("expands variable references when the script runs", func() {
+		var script batchScript
+		script.SetReference("COR_PROFILER_PATH_64", "DEPS_DIR", "\\0\\dynatrace & co\\oneagentloader.dll")
+
+		Expect(script.Script()).To(Equal("set \"COR_PROFILER_PATH_64=%DEPS_DIR%\\0\\dynatrace & co\\oneagentloader.dll\"\r\n"))
+	})
+
+	It("joins the commands with CRLF", func() {
+		var script batchScript
+		script.Set("COR_ENABLE_PROFILING", "1")
+		script.Set("DT_AGENTACTIVE", "true")
+
+		Expect(script.Script()).To(Equal("set \"COR_ENABLE_PROFILING=1\"\r\nset \"DT_AGENTACTIVE=true\"\r\n"))
+	})
+
+	DescribeTable("rejects commands that can't be written safely",
+		func(name string, value string, expected string) {
+			var script batchScript
+			script.Set("DT_AGENTACTIVE", "true")
+			script.Set(name, value)
+
+			_, err := script.Script()
+			Expect(err).To(MatchError(expected))
+		},
+		Entry("a name with spaces", "DT NAME", "1", `invalid variable name "DT NAME"`),
+		Entry("a name with an equal sign", "DT_A=B", "1", `invalid variable name "DT_A=B"`),
+		Entry("a line break", "DT_TAGS", "a\r\nset X=1", "the value of DT_TAGS must not contain line breaks"),
+	)
+})
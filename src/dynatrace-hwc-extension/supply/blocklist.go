@@ -0,0 +1,72 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	blocklistAppend  = "append"
+	blocklistReplace = "replace"
+	blocklistClear   = "clear"
+)
+
+// processes the agent does not instrument unless the blocklist is replaced or cleared
+var defaultBlocklist = []string{"powershell*"}
+
+// Splits a blocklist given as a single string, patterns may be separated by ; or ,.
+func splitBlocklist(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == ',' }) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Returns the process patterns written to DT_BLOCKLIST. The configured patterns are appended to the default ones, replace
+// them or, with the clear mode, the buildpack adds none at all. A DT_BLOCKLIST the app already sets is always kept. Process
+// names are not case sensitive on Windows, so duplicates are removed regardless of the case.
+func agentBlocklist(creds *credentials) ([]string, error) {
+	var patterns []string
+	switch mode := strings.ToLower(strings.TrimSpace(creds.BlocklistMode)); mode {
+	case "", blocklistAppend:
+		patterns = append(append(patterns, defaultBlocklist...), creds.Blocklist...)
+	case blocklistReplace:
+		patterns = creds.Blocklist
+	case blocklistClear:
+		if len(creds.Blocklist) > 0 {
+			return nil, fmt.Errorf("blocklistmode clear does not take any blocklist patterns")
+		}
+	default:
+		return nil, fmt.Errorf("invalid blocklistmode %s, expected append, replace or clear", creds.BlocklistMode)
+	}
+
+	var blocklist []string
+	seen := map[string]bool{}
+	for _, pattern := range append(splitBlocklist(os.Getenv("DT_BLOCKLIST")), patterns...) {
+		if key := strings.ToLower(pattern); !seen[key] {
+			seen[key] = true
+			blocklist = append(blocklist, pattern)
+		}
+	}
+	return blocklist, nil
+}
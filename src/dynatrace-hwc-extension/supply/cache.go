@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// agent packages are cached in this folder of the app cache directory, one sub folder per cache key
+	agentCacheFolder = "dynatrace"
+	agentZipName     = "DynatraceAgent.zip"
+	cacheEntryName   = "entry.json"
+	maxCachedAgents  = 3
+)
+
+// downloadValidators are the response headers that allow a conditional request for a file downloaded before.
+type downloadValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// agentCacheEntry is an agent package stored in the app cache directory. The entry is identified by the Dynatrace environment,
+// the agent version, the package flavor and the network zone, so that changing any of them downloads a new package. A
+// customoneagenturl is only stored as a hash, it may contain credentials.
+type agentCacheEntry struct {
+	Environment string             `json:"environment"`
+	Version     string             `json:"version"`
+	Flavor      string             `json:"flavor"`
+	NetworkZone string             `json:"networkZone,omitempty"`
+	Validators  downloadValidators `json:"validators"`
+
+	dir string
+}
+
+// Returns the cache entry for the agent package described by creds. The validators of a previous download are loaded when
+// the entry already exists.
+func newAgentCacheEntry(s *Supplier, creds *credentials, version string, flavor string) *agentCacheEntry {
+	environment := creds.APIURL
+	if creds.CustomOneAgentURL != "" {
+		sum := sha256.Sum256([]byte(creds.CustomOneAgentURL))
+		environment = "customoneagenturl:" + hex.EncodeToString(sum[:])
+	}
+	if environment == "" {
+		environment = creds.EnvironmentID
+	}
+
+	entry := &agentCacheEntry{
+		Environment: environment,
+		Version:     version,
+		Flavor:      flavor,
+		NetworkZone: creds.NetworkZone,
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{entry.Environment, entry.Version, entry.Flavor, entry.NetworkZone}, "\n")))
+	entry.dir = filepath.Join(s.Stager.CacheDir(), agentCacheFolder, hex.EncodeToString(sum[:8]))
+
+	var cached agentCacheEntry
+	if data, err := ioutil.ReadFile(entry.metadataPath()); err == nil && json.Unmarshal(data, &cached) == nil {
+		entry.Validators = cached.Validators
+	}
+	return entry
+}
+
+func (e *agentCacheEntry) zipPath() string {
+	return filepath.Join(e.dir, agentZipName)
+}
+
+func (e *agentCacheEntry) metadataPath() string {
+	return filepath.Join(e.dir, cacheEntryName)
+}
+
+// Reports whether the agent package of the entry was downloaded before.
+func (e *agentCacheEntry) exists() bool {
+	info, err := os.Stat(e.zipPath())
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Removes the agent package of the entry and forgets its validators so that it is downloaded again.
+func (e *agentCacheEntry) discard() {
+	os.Remove(e.zipPath())
+	e.Validators = downloadValidators{}
+}
+
+// Writes the metadata of the entry. This also marks the entry as the most recently used one.
+func (e *agentCacheEntry) save() error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(e.metadataPath(), data, 0644)
+}
+
+// Removes the least recently used agent packages from the cache, keeping at most maxCachedAgents entries including current.
+func pruneAgentCache(s *Supplier, current *agentCacheEntry) {
+	cacheDir := filepath.Join(s.Stager.CacheDir(), agentCacheFolder)
+	dirs, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+
+	type usedEntry struct {
+		dir      string
+		lastUsed int64
+	}
+	var entries []usedEntry
+	for _, dir := range dirs {
+		path := filepath.Join(cacheDir, dir.Name())
+		if !dir.IsDir() || path == current.dir {
+			continue
+		}
+		lastUsed := dir.ModTime().UnixNano()
+		if info, err := os.Stat(filepath.Join(path, cacheEntryName)); err == nil {
+			lastUsed = info.ModTime().UnixNano()
+		}
+		entries = append(entries, usedEntry{dir: path, lastUsed: lastUsed})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed > entries[j].lastUsed })
+	for i, entry := range entries {
+		if i < maxCachedAgents-1 {
+			continue
+		}
+		s.Log.Info("Removing unused agent package %s from the cache", filepath.Base(entry.dir))
+		if err := os.RemoveAll(entry.dir); err != nil {
+			s.Log.Warning("Unable to remove %s from the cache: %s", entry.dir, err)
+		}
+	}
+}
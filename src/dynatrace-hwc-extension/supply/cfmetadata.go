@@ -0,0 +1,147 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// templates of the Cloud Foundry metadata reported with the processes of the app, used unless the app configures its own
+var (
+	defaultCFTags             = []string{"cf-org={organization_name}", "cf-space={space_name}", "cf-app={application_name}"}
+	defaultCFCustomProperties = map[string]string{"cf-app-guid": "{application_id}"}
+)
+
+// placeholders of the metadata templates
+var cfPlaceholderPattern = regexp.MustCompile(`\{([a-z_]*)\}`)
+
+// characters of a placeholder value that Dynatrace doesn't accept in tags, custom properties and host groups
+var cfUnsafeCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// vcapApplication holds the fields of VCAP_APPLICATION that can be used in the metadata templates.
+type vcapApplication struct {
+	ApplicationName  string `json:"application_name"`
+	ApplicationID    string `json:"application_id"`
+	SpaceName        string `json:"space_name"`
+	SpaceID          string `json:"space_id"`
+	OrganizationName string `json:"organization_name"`
+	OrganizationID   string `json:"organization_id"`
+	// changes with every push of the app
+	ApplicationVersion string `json:"application_version"`
+}
+
+// Parses VCAP_APPLICATION, it is only available when staging in Cloud Foundry.
+func parseVCAPApplication() (*vcapApplication, error) {
+	var app vcapApplication
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// Returns the value of a placeholder, sanitized so that it can be used in any template.
+func (a *vcapApplication) placeholder(name string) (string, bool) {
+	values := map[string]string{
+		"application_name":  a.ApplicationName,
+		"application_id":    a.ApplicationID,
+		"space_name":        a.SpaceName,
+		"space_id":          a.SpaceID,
+		"organization_name": a.OrganizationName,
+		"organization_id":   a.OrganizationID,
+	}
+	value, ok := values[name]
+	return cfUnsafeCharacters.ReplaceAllString(value, "_"), ok
+}
+
+// Replaces the {placeholders} of the template with the values of the app.
+func (a *vcapApplication) expand(template string) (string, error) {
+	var err error
+	expanded := cfPlaceholderPattern.ReplaceAllStringFunc(template, func(match string) string {
+		value, ok := a.placeholder(strings.Trim(match, "{}"))
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown placeholder %s in %q", match, template)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// Adds the Cloud Foundry context of the app, taken from VCAP_APPLICATION, to the tags, custom properties and host group of the
+// agent. The templates come from the app configuration, the settings the app sets explicitly take precedence.
+func applyCloudFoundryMetadata(s *Supplier, config *appConfig, creds *credentials) error {
+	if config.CFMetadata != nil && !*config.CFMetadata {
+		return nil
+	}
+	app, err := parseVCAPApplication()
+	if err != nil {
+		s.Log.Info("No Cloud Foundry metadata for the agent, VCAP_APPLICATION is not available: %s", err)
+		return nil
+	}
+
+	tagTemplates := config.CFTags
+	if tagTemplates == nil {
+		tagTemplates = defaultCFTags
+	}
+	for _, template := range tagTemplates {
+		tag, err := app.expand(template)
+		if err != nil {
+			return fmt.Errorf("invalid cftags: %s", err)
+		}
+		creds.Tags = append(creds.Tags, tag)
+	}
+
+	propertyTemplates := config.CFCustomProperties
+	if propertyTemplates == nil {
+		propertyTemplates = defaultCFCustomProperties
+	}
+	properties := map[string]string{}
+	for _, key := range sortedKeys(propertyTemplates) {
+		value, err := app.expand(propertyTemplates[key])
+		if err != nil {
+			return fmt.Errorf("invalid cfcustomproperties: %s", err)
+		}
+		properties[key] = value
+	}
+	for key, value := range creds.CustomProperties {
+		properties[key] = value
+	}
+	creds.CustomProperties = properties
+
+	if creds.HostGroup == "" && config.CFHostGroup != "" {
+		hostGroup, err := app.expand(config.CFHostGroup)
+		if err != nil {
+			return fmt.Errorf("invalid cfhostgroup: %s", err)
+		}
+		creds.HostGroup = strings.TrimLeft(hostGroup, "_")
+		if len(creds.HostGroup) > 100 {
+			creds.HostGroup = creds.HostGroup[:100]
+		}
+	}
+
+	// the templates may still contain characters the agent doesn't accept
+	metadata := appConfig{Tags: creds.Tags, CustomProperties: creds.CustomProperties, HostGroup: creds.HostGroup}
+	if err := metadata.validate(); err != nil {
+		return err
+	}
+	s.Log.Info("Cloud Foundry metadata: tags %s, custom properties %s, host group %s", strings.Join(creds.Tags, " "),
+		customPropertiesValue(creds.CustomProperties), creds.HostGroup)
+	return nil
+}
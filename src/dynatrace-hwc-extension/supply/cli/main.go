@@ -18,6 +18,7 @@ package main
 
 import (
 	_ "dynatrace-hwc-extension/hooks"
+	"dynatrace-hwc-extension/redact"
 	"dynatrace-hwc-extension/supply"
 	"os"
 	"path/filepath"
@@ -27,7 +28,7 @@ import (
 )
 
 func main() {
-	logger := libbuildpack.NewLogger(os.Stdout)
+	logger := libbuildpack.NewLogger(redact.NewWriter(os.Stdout))
 
 	buildpackDir, err := libbuildpack.GetBuildpackDir()
 	if err != nil {
@@ -90,7 +91,7 @@ func main() {
 		os.Exit(15)
 	}
 
-	if err := stager.WriteConfigYml(nil); err != nil {
+	if err := stager.WriteConfigYml(s.Installation); err != nil {
 		logger.Error("Error writing config.yml: %s", err.Error())
 		os.Exit(16)
 	}
@@ -0,0 +1,427 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	defaultDownloadAttempts = 3
+	defaultDownloadTimeout  = 100 * time.Second
+	initialDownloadBackoff  = 2 * time.Second
+	maxDownloadBackoff      = 60 * time.Second
+	maxRetryAfter           = 5 * time.Minute
+	maxErrorBodySize        = 64 * 1024
+)
+
+// downloadPolicy controls how often and how long the buildpack tries to download the agent.
+type downloadPolicy struct {
+	Attempts       int
+	Timeout        time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// downloadError is returned when the server answered the download request with a non-200 status. RetryAfter is negative when
+// the server did not ask for a specific delay. Message and Violations come from the JSON error body of the Dynatrace API.
+type downloadError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+	URL        string
+	Message    string
+	Violations []string
+}
+
+func (e *downloadError) Error() string {
+	message := "bad status: " + e.Status
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if len(e.Violations) > 0 {
+		message += " [" + strings.Join(e.Violations, "; ") + "]"
+	}
+	if hint := e.hint(); hint != "" {
+		message += " (" + hint + ")"
+	}
+	return message
+}
+
+// transferError is returned when the connection failed while the agent package was transferred, or the received package is
+// incomplete or corrupt. Downloading the package again may succeed.
+type transferError struct {
+	err error
+}
+
+func (e *transferError) Error() string {
+	return e.err.Error()
+}
+
+// retryable reports whether sending the same request again may succeed.
+func (e *downloadError) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// hint returns what the user should check, based on the status code and the error message of the Dynatrace API.
+func (e *downloadError) hint() string {
+	details := strings.ToLower(e.Message + " " + strings.Join(e.Violations, " "))
+	switch {
+	case strings.Contains(details, "network zone") || strings.Contains(details, "networkzone"):
+		return "the network zone is not known to the Dynatrace environment, check networkzone of the Dynatrace service"
+	case e.StatusCode == http.StatusTooManyRequests:
+		return "Dynatrace is rate limiting the requests, stage fewer apps with the same token at the same time"
+	case e.StatusCode == http.StatusUnauthorized:
+		return "the token was rejected, check the paastoken of the Dynatrace service"
+	case e.StatusCode == http.StatusForbidden:
+		return "the token is missing the InstallerDownload permission, check the paastoken of the Dynatrace service"
+	case e.StatusCode == http.StatusNotFound && strings.Contains(details, "environment"):
+		return "the Dynatrace environment does not exist, check the environmentid of the Dynatrace service"
+	case e.StatusCode == http.StatusNotFound && isManagedURLWithoutEnvironment(e.URL):
+		return "the apiurl of Dynatrace Managed and of ActiveGates must have the form https://<host>/e/<environmentid>/api"
+	case e.StatusCode == http.StatusNotFound:
+		return "the download URL does not exist, check the environmentid, apiurl and customoneagenturl of the Dynatrace service"
+	}
+	return ""
+}
+
+// Builds the error of a non-200 response. The JSON error body the Dynatrace API sends,
+// {"error":{"code":..,"message":..,"constraintViolations":[..]}}, is kept for the diagnosis.
+func newDownloadError(resp *http.Response) *downloadError {
+	dlErr := &downloadError{StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: -1}
+	if resp.Request != nil && resp.Request.URL != nil {
+		dlErr.URL = resp.Request.URL.String()
+	}
+	// Retry-After is only meaningful for rate limiting and maintenance responses
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		dlErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+
+	var body struct {
+		Error struct {
+			Message              string `json:"message"`
+			ConstraintViolations []struct {
+				Path              string `json:"path"`
+				Message           string `json:"message"`
+				ParameterLocation string `json:"parameterLocation"`
+			} `json:"constraintViolations"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxErrorBodySize)).Decode(&body); err != nil {
+		return dlErr
+	}
+	dlErr.Message = body.Error.Message
+	for _, violation := range body.Error.ConstraintViolations {
+		if violation.Path != "" {
+			dlErr.Violations = append(dlErr.Violations, violation.Path+": "+violation.Message)
+		} else {
+			dlErr.Violations = append(dlErr.Violations, violation.Message)
+		}
+	}
+	return dlErr
+}
+
+// Reports whether url points to the API of a Dynatrace Managed cluster or ActiveGate without naming the environment.
+// SaaS URLs have the environment in the host name instead.
+func isManagedURLWithoutEnvironment(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	return !isSaaSHost(strings.ToLower(parsed.Hostname())) && !strings.Contains(parsed.Path, "/e/")
+}
+
+// Builds the download policy from the defaults, the app can override them with DT_DOWNLOAD_ATTEMPTS and DT_DOWNLOAD_TIMEOUT
+// (in seconds) set through cf set-env.
+func newDownloadPolicy(s *Supplier) downloadPolicy {
+	policy := downloadPolicy{
+		Attempts:       defaultDownloadAttempts,
+		Timeout:        defaultDownloadTimeout,
+		InitialBackoff: initialDownloadBackoff,
+		MaxBackoff:     maxDownloadBackoff,
+	}
+
+	if value := os.Getenv("DT_DOWNLOAD_ATTEMPTS"); value != "" {
+		if attempts, err := strconv.Atoi(value); err == nil && attempts > 0 {
+			policy.Attempts = attempts
+		} else {
+			s.Log.Warning("Ignoring invalid DT_DOWNLOAD_ATTEMPTS=%s, using %d", value, policy.Attempts)
+		}
+	}
+
+	if value := os.Getenv("DT_DOWNLOAD_TIMEOUT"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			policy.Timeout = time.Duration(seconds) * time.Second
+		} else {
+			s.Log.Warning("Ignoring invalid DT_DOWNLOAD_TIMEOUT=%s, using %s", value, policy.Timeout)
+		}
+	}
+
+	return policy
+}
+
+// Returns how long to wait before the given attempt (starting at 1 for the first retry). The delay grows exponentially and half
+// of it is randomized so that several apps staging at the same time don't hit the server together.
+func (p downloadPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Given the url and the filepath, this function downloads Dynatrace Paas agent. Connection errors, statuses that indicate a
+// temporary problem on the server side and corrupt packages are retried according to the download policy, configuration
+// errors fail right away. When filepath already exists, the request is made conditional on the given validators and the
+// returned flag tells whether the file was downloaded again.
+func downloadDependency(s *Supplier, creds *credentials, url string, filepath string, validators *downloadValidators) (modified bool, err error) {
+	//s.Log.Info("Downloading from [%s]", url)
+	s.Log.Info("Saving to [%s]", filepath)
+	policy := newDownloadPolicy(s)
+
+	expectedSha256, err := expectedAgentSha256(creds)
+	if err != nil {
+		return false, err
+	}
+
+	httpClient, err := newHTTPClient(s, creds, policy.Timeout)
+	if err != nil {
+		return false, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		s.Log.Info("Download attempt %d of %d", attempt, policy.Attempts)
+		modified, err = downloadOnce(httpClient, creds, url, filepath, expectedSha256, validators)
+		if err == nil {
+			return modified, nil
+		}
+
+		if isCertificateError(err) {
+			return false, certificateError(err)
+		}
+
+		if !retryableDownload(err) {
+			return false, err
+		}
+		delay := policy.backoff(attempt)
+		if dlErr, ok := err.(*downloadError); ok && dlErr.RetryAfter >= 0 {
+			delay = dlErr.RetryAfter
+		}
+
+		if attempt >= policy.Attempts {
+			return false, fmt.Errorf("download failed after %d attempts: %s", attempt, err)
+		}
+		s.Log.Warning("Download attempt %d failed: %s. Retrying in %s", attempt, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// Reports whether a failed download attempt may succeed when it is repeated.
+func retryableDownload(err error) bool {
+	switch e := err.(type) {
+	case *downloadError:
+		return e.retryable()
+	case *transferError:
+		return true
+	}
+	return false
+}
+
+// Builds the HTTP client used to talk to Dynatrace. Requests go through the proxy configured in the Dynatrace service when
+// there is one, otherwise through the proxy given by HTTP_PROXY, HTTPS_PROXY and NO_PROXY. The transport is built once per
+// staging and shared by all clients, so the proxy and TLS settings are only loaded and logged once.
+func newHTTPClient(s *Supplier, creds *credentials, timeout time.Duration) (*http.Client, error) {
+	if creds.transport == nil {
+		proxy, err := proxyFunc(s, creds)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig, err := newTLSConfig(s, creds)
+		if err != nil {
+			return nil, err
+		}
+
+		creds.transport = &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: creds.transport,
+	}, nil
+}
+
+// Returns the proxy selection function of the transport. A proxy set in the credentials is used for both http and https
+// requests, NO_PROXY still applies to it. Basic auth can be given in the proxy URL or with proxyusername and proxypassword.
+func proxyFunc(s *Supplier, creds *credentials) (func(*http.Request) (*url.URL, error), error) {
+	if creds.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(creds.Proxy)
+	if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy in the Dynatrace service, expected http(s)://[user:password@]host:port")
+	}
+	if creds.ProxyUsername != "" {
+		proxyURL.User = url.UserPassword(creds.ProxyUsername, creds.ProxyPassword)
+	}
+
+	logURL := *proxyURL
+	if logURL.User != nil {
+		logURL.User = url.User(logURL.User.Username())
+	}
+	s.Log.Info("Using proxy %s from the Dynatrace service", logURL.String())
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	config := &httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    noProxy,
+	}
+	selectProxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return selectProxy(req.URL)
+	}, nil
+}
+
+// Sends a single download request and writes the body to filepath. The PaaS token is only sent to the Dynatrace deployment
+// API, a custom agent URL may point to any server. The body is written to a temporary file and verified first so that a failed
+// or corrupt download never replaces a file downloaded before.
+func downloadOnce(httpClient *http.Client, creds *credentials, url string, filepath string, expectedSha256 string, validators *downloadValidators) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if creds.CustomOneAgentURL == "" {
+		req.Header.Set("Authorization", "Api-Token "+creds.PaasToken)
+	}
+	conditional := false
+	if _, err := os.Stat(filepath); err == nil && validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+			conditional = true
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+			conditional = true
+		}
+	}
+
+	// Get the data
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, &transferError{err}
+	}
+	defer resp.Body.Close()
+
+	// Check server response
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, newDownloadError(resp)
+	}
+
+	// Create the file
+	tmpFile := filepath + ".download"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpFile)
+
+	// Writer the body to file
+	written, err := io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, &transferError{err}
+	}
+
+	// A truncated or corrupt package is deleted by the deferred Remove and downloaded again by the next attempt
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return false, &transferError{fmt.Errorf("incomplete download, received %d of %d bytes", written, resp.ContentLength)}
+	}
+	if err := verifyAgentPackage(tmpFile, expectedSha256); err != nil {
+		if _, ok := err.(*checksumError); ok {
+			return false, err
+		}
+		return false, &transferError{err}
+	}
+
+	if err := os.Rename(tmpFile, filepath); err != nil {
+		return false, err
+	}
+
+	if validators != nil {
+		validators.ETag = resp.Header.Get("ETag")
+		validators.LastModified = resp.Header.Get("Last-Modified")
+	}
+	return true, nil
+}
+
+// Parses a Retry-After header given either in seconds or as an HTTP date. It returns -1 when the header is missing or invalid
+// and caps the result to maxRetryAfter.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return -1
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+	} else {
+		return -1
+	}
+
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
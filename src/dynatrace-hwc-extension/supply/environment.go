@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"os"
+	"strings"
+)
+
+// source of the credentials read from the environment variables
+const environmentSource = "environment variables"
+
+// environmentVariables maps the credentials keys that can be set with cf set-env to their environment variable. Runtime
+// variables are also read by the agent when the app starts, whatever the staging used.
+var environmentVariables = []struct {
+	Key      string
+	Variable string
+	Runtime  bool
+}{
+	{"environmentid", "DT_ENVIRONMENT_ID", false},
+	{"apiurl", "DT_API_URL", false},
+	{"apitoken", "DT_API_TOKEN", false},
+	{"paastoken", "DT_PAAS_TOKEN", false},
+	{"networkzone", "DT_NETWORK_ZONE", true},
+	{"customoneagenturl", "DT_CUSTOM_ONEAGENT_URL", false},
+	{"skiperrors", "DT_SKIP_ERRORS", false},
+}
+
+// Returns the names of the configuration environment variables that are set, the runtime variables only when withRuntime
+// is true.
+func configuredEnvironmentVariables(withRuntime bool) []string {
+	var names []string
+	for _, env := range environmentVariables {
+		if os.Getenv(env.Variable) != "" && (withRuntime || !env.Runtime) {
+			names = append(names, env.Variable)
+		}
+	}
+	return names
+}
+
+// Returns the setting of a credentials key from its environment variable, keys without a variable are never set.
+func environmentCredential(key string) string {
+	for _, env := range environmentVariables {
+		if env.Key == key {
+			return strings.TrimSpace(os.Getenv(env.Variable))
+		}
+	}
+	return ""
+}
+
+// Configures the agent from the DT_* environment variables when no Dynatrace service is bound to the app. DT_PAAS_TOKEN is
+// required, an app that only sets runtime variables such as DT_NETWORK_ZONE is not configured for the buildpack. The
+// variables are validated like the credentials of a service.
+func detectEnvironmentConfiguration(s *Supplier) (bool, *credentials, error) {
+	if os.Getenv("DT_PAAS_TOKEN") == "" {
+		if names := configuredEnvironmentVariables(false); len(names) > 0 {
+			s.Log.Info("Not using the environment variables %s, DT_PAAS_TOKEN is not set", strings.Join(names, ", "))
+		}
+		return false, nil, nil
+	}
+
+	names := configuredEnvironmentVariables(true)
+	s.Log.Info("No Dynatrace service is bound, using the environment variables %s", strings.Join(names, ", "))
+	creds := newCredentials(s, environmentSource, environmentCredential)
+	if creds == nil {
+		return false, nil, nil
+	}
+	if err := normalizeAPIURL(s, creds); err != nil {
+		return false, nil, err
+	}
+	return true, creds, nil
+}
+
+// Returns the name the user has to fix for the given credentials key: the key itself for a service, or its environment
+// variable when the credentials were read from the environment.
+func credentialName(creds *credentials, key string) string {
+	if creds.ServiceName != environmentSource {
+		return key
+	}
+	for _, env := range environmentVariables {
+		if env.Key == key {
+			return env.Variable
+		}
+	}
+	return key
+}
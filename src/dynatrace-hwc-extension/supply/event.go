@@ -0,0 +1,155 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the deployment event must not hold up the staging for long
+const eventRequestTimeout = 10 * time.Second
+
+// deploymentEvent is the CUSTOM_DEPLOYMENT event supply sends to the Dynatrace Events API once the agent is installed.
+type deploymentEvent struct {
+	Title          string            `json:"title"`
+	EntitySelector string            `json:"entitySelector,omitempty"`
+	Properties     map[string]string `json:"properties"`
+}
+
+// Builds the deployment event of the staged app. The event targets the processes carrying the tags the buildpack sets.
+func newDeploymentEvent(s *Supplier, creds *credentials, buildpackDir string) *deploymentEvent {
+	app, err := parseVCAPApplication()
+	if err != nil {
+		app = &vcapApplication{}
+	}
+
+	properties := map[string]string{
+		"dt.event.deployment.name":                  app.ApplicationName,
+		"dt.event.deployment.version":               creds.Release.Version,
+		"dt.event.deployment.release_stage":         creds.Release.Stage,
+		"dt.event.deployment.release_product":       creds.Release.Product,
+		"dt.event.deployment.release_build_version": creds.Release.BuildVersion,
+		"cf.application.name":                       app.ApplicationName,
+		"cf.application.id":                         app.ApplicationID,
+		"cf.space.name":                             app.SpaceName,
+		"cf.organization.name":                      app.OrganizationName,
+		"buildpack.version":                         buildpackVersion(buildpackDir),
+		"agent.version":                             s.Installation.AgentVersion,
+		"git.commit":                                gitCommit(s.Stager.BuildDir()),
+	}
+	for key, value := range properties {
+		// the version stays latest when the agent package does not tell which version it is
+		if value == "" || (key == "agent.version" && value == "latest") {
+			delete(properties, key)
+		}
+	}
+
+	var selectors []string
+	for _, tag := range creds.Tags {
+		// tags set through DT_TAGS show up as [Environment]key:value in Dynatrace
+		selectors = append(selectors, `tag("[Environment]`+strings.Replace(strings.Replace(tag, `"`, `\"`, -1), "=", ":", 1)+`")`)
+	}
+	event := &deploymentEvent{Title: "Cloud Foundry deployment", Properties: properties}
+	if app.ApplicationName != "" {
+		event.Title = "Cloud Foundry deployment of " + app.ApplicationName
+	}
+	if len(selectors) > 0 {
+		event.EntitySelector = "type(PROCESS_GROUP_INSTANCE)," + strings.Join(selectors, ",")
+	}
+	return event
+}
+
+// Returns the version of the buildpack, or an empty string when it is unknown.
+func buildpackVersion(buildpackDir string) string {
+	version, err := ioutil.ReadFile(filepath.Join(buildpackDir, "VERSION"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(version))
+}
+
+// Returns the git commit of the app, given by GIT_COMMIT or read from a .git directory pushed with the app.
+func gitCommit(buildDir string) string {
+	if commit := os.Getenv("GIT_COMMIT"); commit != "" {
+		return commit
+	}
+	head, err := ioutil.ReadFile(filepath.Join(buildDir, ".git", "HEAD"))
+	if err != nil {
+		return ""
+	}
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: ") {
+		return ref
+	}
+	commit, err := ioutil.ReadFile(filepath.Join(buildDir, ".git", filepath.FromSlash(strings.TrimPrefix(ref, "ref: "))))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(commit))
+}
+
+// Posts the deployment event to the Events API of the Dynatrace environment with the apitoken of the credentials. Supply
+// sends it because finalize does not run when the buildpack is followed by another one, as with the hwc buildpack.
+func sendDeploymentEvent(s *Supplier, creds *credentials, event *deploymentEvent) error {
+	if creds.APIToken == "" {
+		s.Log.Warning("Not sending the deployment event, %s is not set", credentialName(creds, "apitoken"))
+		return nil
+	}
+
+	httpClient, err := newHTTPClient(s, creds, eventRequestTimeout)
+	if err != nil {
+		return err
+	}
+
+	payload := struct {
+		EventType string `json:"eventType"`
+		*deploymentEvent
+	}{"CUSTOM_DEPLOYMENT", event}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, apiBaseURL(creds)+"/v2/events/ingest", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Api-Token "+creds.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if isCertificateError(err) {
+			return certificateError(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return newDownloadError(resp)
+	}
+	s.Log.Info("Sent the deployment event to Dynatrace")
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// technologies the deployment API accepts in the include parameter
+var agentTechnologies = map[string]bool{
+	"all": true, "apache": true, "dotnet": true, "go": true, "java": true, "nginx": true, "nodejs": true, "php": true, "sdk": true,
+}
+
+// agentFlavor selects which parts of the Paas agent package are downloaded.
+type agentFlavor struct {
+	Bitness string
+	Include []string
+}
+
+// Builds the package flavor from the bitness and include entries of the credentials. Without them the full package for all
+// architectures and technologies is downloaded.
+func newAgentFlavor(creds *credentials) (agentFlavor, error) {
+	flavor := agentFlavor{Bitness: strings.TrimSpace(creds.Bitness)}
+	switch flavor.Bitness {
+	case "", "all", "32", "64":
+	default:
+		return flavor, fmt.Errorf("invalid bitness %s, expected 32, 64 or all", creds.Bitness)
+	}
+
+	for _, technology := range strings.Split(creds.Include, ",") {
+		technology = strings.ToLower(strings.TrimSpace(technology))
+		if technology == "" {
+			continue
+		}
+		if !agentTechnologies[technology] {
+			return flavor, fmt.Errorf("invalid include technology %s, expected one of %s", technology, strings.Join(knownTechnologies(), ", "))
+		}
+		flavor.Include = append(flavor.Include, technology)
+	}
+	sort.Strings(flavor.Include)
+	return flavor, nil
+}
+
+func knownTechnologies() []string {
+	var technologies []string
+	for technology := range agentTechnologies {
+		technologies = append(technologies, technology)
+	}
+	sort.Strings(technologies)
+	return technologies
+}
+
+// Adds the flavor to the query of a deployment API request.
+func (f agentFlavor) addQuery(qv url.Values) {
+	if f.Bitness != "" {
+		qv.Set("bitness", f.Bitness)
+	}
+	for _, technology := range f.Include {
+		qv.Add("include", technology)
+	}
+}
+
+// String identifies the flavor in the agent cache.
+func (f agentFlavor) String() string {
+	if f.Bitness == "" && len(f.Include) == 0 {
+		return "default"
+	}
+	return fmt.Sprintf("bitness=%s;include=%s", f.Bitness, strings.Join(f.Include, ","))
+}
+
+// Returns the agent folder holding the libraries of the given architecture (32 or 64).
+func agentLibFolder(architecture string) string {
+	if architecture == "64" {
+		return "lib64"
+	}
+	return "lib"
+}
+
+// AgentLoaderPath returns the location of the profiler loader of the given architecture below the agent folder.
+func AgentLoaderPath(dtAgentPath string, architecture string) string {
+	return filepath.Join(dtAgentPath, "agent", agentLibFolder(architecture), "oneagentloader.dll")
+}
+
+// ConfiguredArchitectures returns the architectures (32 and/or 64) the app needs a profiler for with the given bitness.
+func ConfiguredArchitectures(bitness string) []string {
+	switch bitness {
+	case "32", "64":
+		return []string{bitness}
+	}
+	return []string{"32", "64"}
+}
+
+// Returns the architectures of ConfiguredArchitectures(bitness) that are not in installed.
+func missingArchitectures(installed []string, bitness string) []string {
+	var missing []string
+	for _, architecture := range ConfiguredArchitectures(bitness) {
+		found := false
+		for _, candidate := range installed {
+			found = found || candidate == architecture
+		}
+		if !found {
+			missing = append(missing, architecture)
+		}
+	}
+	return missing
+}
+
+// agentManifest holds the version information of the manifest.json of the agent package. The version may be given for the
+// whole package or only for the binaries of each technology and platform.
+type agentManifest struct {
+	Version      string                              `json:"version"`
+	Technologies map[string]map[string][]agentBinary `json:"technologies"`
+}
+
+type agentBinary struct {
+	Version string `json:"version"`
+}
+
+// Returns the version of the extracted agent package, or an empty string when its manifest.json does not tell. The version
+// of the .NET binaries is preferred over the ones of the other technologies.
+func installedAgentVersion(dtAgentPath string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dtAgentPath, "manifest.json"))
+	if err != nil {
+		return ""
+	}
+	var manifest agentManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return ""
+	}
+	if manifest.Version != "" {
+		return manifest.Version
+	}
+
+	technologies := []string{"dotnet"}
+	for technology := range manifest.Technologies {
+		if technology != "dotnet" {
+			technologies = append(technologies, technology)
+		}
+	}
+	sort.Strings(technologies[1:])
+	for _, technology := range technologies {
+		platforms := manifest.Technologies[technology]
+		names := make([]string, 0, len(platforms))
+		for name := range platforms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, binary := range platforms[name] {
+				if binary.Version != "" {
+					return binary.Version
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the architectures (32 and/or 64) the extracted agent package contains a profiler for.
+func installedArchitectures(dtAgentPath string) []string {
+	var architectures []string
+	for _, architecture := range []string{"32", "64"} {
+		if info, err := os.Stat(AgentLoaderPath(dtAgentPath, architecture)); err == nil && info.Mode().IsRegular() {
+			architectures = append(architectures, architecture)
+		}
+	}
+	return architectures
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// checksumError is returned when a complete agent package does not match agentsha256. Downloading it again returns the same
+// package, the checksum belongs to another agent version.
+type checksumError struct {
+	err error
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("the agent package does not match agentsha256: %s (agentsha256 must belong to the installed agentversion)", e.err)
+}
+
+// Checks that the file at path is a complete agent package: a readable zip archive whose SHA-256 matches expectedSha256
+// when one is given.
+func verifyAgentPackage(path string, expectedSha256 string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		if looksLikeHTML(path) {
+			return errors.New("the server returned an HTML page instead of the agent package")
+		}
+		return fmt.Errorf("the agent package is not a valid zip archive: %s", err)
+	}
+	archive.Close()
+
+	if expectedSha256 != "" {
+		if err := libbuildpack.CheckSha256(path, expectedSha256); err != nil {
+			return &checksumError{err}
+		}
+	}
+	return nil
+}
+
+// Reports whether the file at path starts like an HTML document, as error pages of proxies and login portals do.
+func looksLikeHTML(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	head = bytes.ToLower(bytes.TrimSpace(head[:n]))
+	return bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html"))
+}
+
+// Normalizes the expected SHA-256 of the credentials and checks its format.
+func expectedAgentSha256(creds *credentials) (string, error) {
+	sum := strings.ToLower(strings.TrimSpace(creds.AgentSha256))
+	if sum != "" && !sha256Pattern.MatchString(sum) {
+		return "", fmt.Errorf("invalid agentsha256 %s, expected 64 hexadecimal characters", creds.AgentSha256)
+	}
+	return sum, nil
+}
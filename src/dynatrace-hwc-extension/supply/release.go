@@ -0,0 +1,65 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"os"
+	"strings"
+)
+
+// releaseMetadata is reported by the agent for Dynatrace release tracking.
+type releaseMetadata struct {
+	Version      string
+	Stage        string
+	Product      string
+	BuildVersion string
+}
+
+// Determines the release metadata of the app. Each field comes from the app configuration, otherwise from the DT_RELEASE_*
+// environment variable of the app, otherwise from VCAP_APPLICATION: the version of the push, the space as stage and the app
+// name as product. There is no default build version.
+func applyReleaseMetadata(s *Supplier, config *appConfig, creds *credentials) {
+	app, err := parseVCAPApplication()
+	if err != nil {
+		app = &vcapApplication{}
+	}
+
+	var sources []string
+	resolve := func(field string, configured string, variable string, fallback string) string {
+		value, source := configured, config.source
+		if value == "" {
+			value, source = os.Getenv(variable), variable
+		}
+		if value == "" {
+			value, source = fallback, "VCAP_APPLICATION"
+		}
+		if value != "" {
+			sources = append(sources, field+" "+value+" (from "+source+")")
+		}
+		return value
+	}
+
+	creds.Release = releaseMetadata{
+		Version:      resolve("version", config.ReleaseVersion, "DT_RELEASE_VERSION", app.ApplicationVersion),
+		Stage:        resolve("stage", config.ReleaseStage, "DT_RELEASE_STAGE", app.SpaceName),
+		Product:      resolve("product", config.ReleaseProduct, "DT_RELEASE_PRODUCT", app.ApplicationName),
+		BuildVersion: resolve("build version", config.ReleaseBuildVersion, "DT_RELEASE_BUILD_VERSION", ""),
+	}
+	if len(sources) > 0 {
+		s.Log.Info("Release metadata: %s", strings.Join(sources, ", "))
+	}
+}
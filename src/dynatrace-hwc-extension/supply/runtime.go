@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// runtimeFramework is the .NET Framework CLR, profiled through the COR_* variables
+	runtimeFramework = "framework"
+	// runtimeCore is .NET Core and .NET 5+, profiled through the CORECLR_* variables
+	runtimeCore = "core"
+
+	dynatraceProfilerGUID = "{B7038F67-52FC-4DA2-AB02-969B3C1EDA03}"
+)
+
+// Returns the .NET runtimes the profiler is configured for. The runtime entry of the credentials selects framework, core or
+// all. Without it the .NET Framework is always profiled and .NET Core is added when the app has a *.runtimeconfig.json.
+func profiledRuntimes(s *Supplier, creds *credentials) ([]string, error) {
+	switch strings.ToLower(strings.TrimSpace(creds.Runtime)) {
+	case runtimeFramework:
+		return []string{runtimeFramework}, nil
+	case runtimeCore:
+		return []string{runtimeCore}, nil
+	case "all":
+		return []string{runtimeFramework, runtimeCore}, nil
+	case "":
+		runtimeConfigs, _ := filepath.Glob(filepath.Join(s.Stager.BuildDir(), "*.runtimeconfig.json"))
+		if len(runtimeConfigs) > 0 {
+			s.Log.Info("Detected a .NET Core app (%s)", filepath.Base(runtimeConfigs[0]))
+			return []string{runtimeFramework, runtimeCore}, nil
+		}
+		return []string{runtimeFramework}, nil
+	}
+	return nil, fmt.Errorf("invalid runtime %s, expected framework, core or all", creds.Runtime)
+}
+
+// Returns the prefix of the profiler environment variables of the given runtime.
+func profilerVariablePrefix(runtime string) string {
+	if runtime == runtimeCore {
+		return "CORECLR_"
+	}
+	return "COR_"
+}
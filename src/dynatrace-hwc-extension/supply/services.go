@@ -0,0 +1,163 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serviceNameEnv selects the Dynatrace service by name when the app is bound to more than one.
+const serviceNameEnv = "DT_SERVICE_NAME"
+
+// vcapService is a single service binding of VCAP_SERVICES, either of a brokered or of a user-provided service.
+type vcapService struct {
+	Name         string                 `json:"name"`
+	InstanceName string                 `json:"instance_name"`
+	Label        string                 `json:"label"`
+	Tags         []string               `json:"tags"`
+	Credentials  map[string]interface{} `json:"credentials"`
+}
+
+// Parses VCAP_SERVICES into a flat list of bindings. The services are ordered by their label and keep the order of
+// VCAP_SERVICES within a label, so that the same bindings are always looked at in the same order.
+func parseVCAPServices() ([]vcapService, error) {
+	var vcapServices map[string][]vcapService
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_SERVICES")), &vcapServices); err != nil {
+		return nil, err
+	}
+
+	labels := make([]string, 0, len(vcapServices))
+	for label := range vcapServices {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var services []vcapService
+	for _, label := range labels {
+		for _, service := range vcapServices[label] {
+			if service.Label == "" {
+				service.Label = label
+			}
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// isDynatrace reports whether the name, the label or one of the tags of the binding refers to Dynatrace, or whether its
+// credentials look like the ones of a Dynatrace service. User-provided services are often named after the team or stage.
+func (v vcapService) isDynatrace() bool {
+	if strings.Contains(strings.ToLower(v.Name), "dynatrace") || strings.Contains(strings.ToLower(v.Label), "dynatrace") {
+		return true
+	}
+	for _, tag := range v.Tags {
+		if strings.EqualFold(tag, "dynatrace") {
+			return true
+		}
+	}
+	return (v.credential("environmentid") != "" || v.credential("apiurl") != "") && v.credential("paastoken") != ""
+}
+
+// matchesName reports whether the binding has the given name or was created from the service instance of that name.
+func (v vcapService) matchesName(name string) bool {
+	return v.Name == name || v.InstanceName == name
+}
+
+// Returns a credential of the binding as a string. User-provided services are created from arbitrary JSON, so booleans and
+// numbers are accepted too.
+func (v vcapService) credential(key string) string {
+	return credentialString(v.Credentials[key])
+}
+
+// Returns the credential value as a string, or an empty string for objects and lists.
+func credentialString(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
+
+// Returns the bindings the agent may be configured from. With DT_SERVICE_NAME set only the binding of that name is returned,
+// whatever its name, label and tags are, otherwise all the Dynatrace bindings are.
+func candidateServices(s *Supplier, services []vcapService) ([]vcapService, error) {
+	if name := os.Getenv(serviceNameEnv); name != "" {
+		for _, service := range services {
+			if service.matchesName(name) {
+				s.Log.Info("Using service %s selected with %s", name, serviceNameEnv)
+				return []vcapService{service}, nil
+			}
+		}
+		return nil, fmt.Errorf("%s=%s does not match any service bound to the app", serviceNameEnv, name)
+	}
+
+	var candidates []vcapService
+	for _, service := range services {
+		if service.isDynatrace() {
+			candidates = append(candidates, service)
+		}
+	}
+	return candidates, nil
+}
+
+// Returns an error naming all the usable bindings when there is more than one, the agent could otherwise report to a
+// different environment on every staging.
+func ambiguousServices(found []*credentials) error {
+	names := make([]string, 0, len(found))
+	for _, creds := range found {
+		names = append(names, creds.ServiceName)
+	}
+	return fmt.Errorf("the app is bound to %d Dynatrace services (%s), set %s to the name of the one to use", len(found),
+		strings.Join(names, ", "), serviceNameEnv)
+}
+
+// Returns the agent settings of the binding: every credential whose key starts with DT_, and the entries of agentoptions,
+// which may be an object or a JSON encoded object. agentoptions takes precedence when both set the same variable.
+func (v vcapService) agentOptions() (map[string]string, error) {
+	options := map[string]string{}
+	for key, value := range v.Credentials {
+		if strings.HasPrefix(strings.ToUpper(key), "DT_") {
+			options[key] = credentialString(value)
+		}
+	}
+
+	var agentOptions map[string]interface{}
+	switch value := v.Credentials["agentoptions"].(type) {
+	case nil:
+	case map[string]interface{}:
+		agentOptions = value
+	case string:
+		if err := json.Unmarshal([]byte(value), &agentOptions); err != nil {
+			return nil, fmt.Errorf("agentoptions of service %s is not a JSON object: %s", v.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("agentoptions of service %s is not an object", v.Name)
+	}
+	for key, value := range agentOptions {
+		options[key] = credentialString(value)
+	}
+	return options, nil
+}
@@ -28,12 +28,12 @@ import (
 	"strings"
 
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/url"
-	"time"
+
+	"dynatrace-hwc-extension/redact"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
@@ -93,12 +93,24 @@ type Supplier struct {
 	Stager    Stager
 	Command   Command
 	Log       *libbuildpack.Logger
+	// Installation describes the installed agent, it is written to config.yml of the dependency directory
+	Installation Installation
 	/* unused calls
 	Config    *config.Config
 	Project   *project.Project
 	*/
 }
 
+// Installation records what supply installed so that later stages can rely on it.
+type Installation struct {
+	Installed     bool     `yaml:"installed"`
+	SkipErrors    bool     `yaml:"skip_errors,omitempty"`
+	AgentVersion  string   `yaml:"agent_version,omitempty"`
+	Bitness       string   `yaml:"bitness,omitempty"`
+	Architectures []string `yaml:"architectures,omitempty"`
+	Runtimes      []string `yaml:"runtimes,omitempty"`
+}
+
 // credentials represent the user settings extracted from the environment.
 type credentials struct {
 	ServiceName       string
@@ -109,8 +121,31 @@ type credentials struct {
 	APIURL            string
 	SkipErrors        bool
 	NetworkZone       string
-	// DT_CONNECTION_POINT=abc;zdlk;lkfd
-	// DT_NETWORK_ZONE
+	AgentVersion      string
+	AgentSha256       string
+	Bitness           string
+	Include           string
+	Runtime           string
+	Proxy             string
+	ProxyUsername     string
+	ProxyPassword     string
+	CACert            string
+	CACertFile        string
+	Insecure          bool
+	Blocklist         []string
+	BlocklistMode     string
+	AgentOptions      map[string]string
+	Release           releaseMetadata
+	DeploymentEvent   bool
+	// settings of the app configuration file
+	HostGroup        string
+	Tags             []string
+	CustomProperties map[string]string
+	LogLevelCon      string
+	LogLevelFile     string
+
+	// transport is shared by all requests to Dynatrace, see newHTTPClient
+	transport *http.Transport
 }
 
 const dynatraceAgentFolder = "dynatrace"
@@ -126,12 +161,31 @@ func (s *Supplier) Run() error {
 	s.Log.Info("  >>>>>>> DepsDir : %s", s.Stager.DepsDir())
 	s.Log.Info("  >>>>>>> CacheDir: %s", s.Stager.CacheDir())
 
-	var creds *credentials
-	var DTServiceExists bool
-	if DTServiceExists, creds = detectDynatraceServices(s); !DTServiceExists {
+	config, err := loadAppConfig(s)
+	if err != nil {
+		s.Log.Error("Unable to load the Dynatrace configuration of the app: %s", err)
+		return err
+	}
+	if config.Disabled {
+		s.Log.Info("The Dynatrace agent is disabled in %s", config.source)
+		return nil
+	}
+
+	DTServiceExists, creds, err := detectDynatraceServices(s)
+	if err != nil {
+		s.Log.Error("Unable to select the Dynatrace service: %s", err)
+		return err
+	}
+	if !DTServiceExists {
 		s.Log.Info("No Dynatrace service to bind to...")
 		return nil
 	}
+	config.applyTo(s, creds)
+	if err := applyCloudFoundryMetadata(s, config, creds); err != nil {
+		s.Log.Error("Unable to add the Cloud Foundry metadata: %s", err)
+		return err
+	}
+	applyReleaseMetadata(s, config, creds)
 
 	s.Log.BeginStep("Installing Dynatrace .Net Agent")
 
@@ -142,121 +196,305 @@ func (s *Supplier) Run() error {
 	}
 	s.Log.Info("buildpackDir: %v", buildpackDir)
 
-	s.Log.BeginStep("Creating cache directory " + s.Stager.CacheDir())
-	if err := os.MkdirAll(s.Stager.CacheDir(), 0755); err != nil {
-		s.Log.Error("Failed to create cache directory "+s.Stager.CacheDir(), err)
+	dtAgentPath := filepath.Join(s.Stager.DepDir(), dynatraceAgentFolder)
+	s.Log.Info("Dynatrace Agent Path: %s", dtAgentPath)
+
+	// Download, extract and configure the agent. When skiperrors is set in the service credentials a failure here must not
+	// fail the staging, the app is pushed without the agent instead.
+	s.Installation.SkipErrors = creds.SkipErrors
+	if err := installAgent(s, creds, dtAgentPath); err != nil {
+		if !creds.SkipErrors {
+			return err
+		}
+		s.Installation = Installation{SkipErrors: true}
+		s.Log.Warning("Dynatrace agent installation failed, continuing without the agent because skiperrors is set: %s", err)
+		if err := os.RemoveAll(dtAgentPath); err != nil {
+			s.Log.Warning("Unable to remove partially installed agent at %s: %s", dtAgentPath, err)
+		}
+		return getProcfile(s, buildpackDir)
+	}
+
+	// Build procfile so that CF can execute the hwc command
+	if err := getProcfile(s, buildpackDir); err != nil {
+		return err
+	}
+
+	// Build dynatrace.bat file in profile.d directory of the app. This batch file sets all the env variables required for the agent to work
+	if err := buildProfileD(s, *creds, dtAgentPath); err != nil {
 		return err
 	}
 
-	downloadsDir := filepath.Join(s.Stager.DepDir(), "downlaods")
+	s.Installation.Installed = true
+	s.Log.Info("Installing Dynatrace Agent Completed.")
 
-	if err := os.MkdirAll(downloadsDir, 0755); err != nil {
-		s.Log.Error("Failed to create downloads directory "+downloadsDir, err)
+	// the event is only a report, it must never fail the staging
+	if creds.DeploymentEvent {
+		if err := sendDeploymentEvent(s, creds, newDeploymentEvent(s, creds, buildpackDir)); err != nil {
+			s.Log.Warning("Unable to send the deployment event to Dynatrace: %s", err)
+		}
+	}
+	return nil
+}
+
+// Downloads the Dynatrace Paas agent, extracts it to dtAgentPath and creates the standalone.conf file the agent needs to connect to the
+// cluster. Any error returned leaves dtAgentPath in an undefined state.
+func installAgent(s *Supplier, creds *credentials, dtAgentPath string) error {
+	s.Log.BeginStep("Creating cache directory %s", s.Stager.CacheDir())
+	if err := os.MkdirAll(s.Stager.CacheDir(), 0755); err != nil {
+		s.Log.Error("Failed to create cache directory %s: %s", s.Stager.CacheDir(), err)
 		return err
 	}
 
-	dtDownloadLocalFilename := filepath.Join(downloadsDir, "DynatraceAgent.zip")
+	if err := validateTokens(s, creds); err != nil {
+		s.Log.Error("Error validating the Dynatrace tokens: %s", err)
+		return err
+	}
 
-	s.Log.Info("dtDownloadLocalFilename=" + dtDownloadLocalFilename)
-	dtAgentPath := filepath.Join(s.Stager.DepDir(), dynatraceAgentFolder)
-	s.Log.Info("Dynatrace Agent Path: " + dtAgentPath)
+	version, err := resolveAgentVersion(s, creds)
+	if err != nil {
+		s.Log.Error("Error resolving the Dynatrace agent version: %s", err)
+		return err
+	}
+	s.Log.Info("Dynatrace agent version: %s", version)
+	s.Installation.AgentVersion = version
 
-	//dtDownloadURL := getDownloadURL(creds) + "?Api-Token=" + creds.PaasToken
-	dtDownloadURL := getDownloadURL(creds)
+	flavor, err := newAgentFlavor(creds)
+	if err != nil {
+		s.Log.Error("Error selecting the Dynatrace agent package: %s", err)
+		return err
+	}
+	s.Installation.Bitness = flavor.Bitness
+	if creds.CustomOneAgentURL != "" && flavor.String() != "default" {
+		s.Log.Warning("Ignoring bitness and include, the agent is downloaded from customoneagenturl")
+	}
+	s.Log.Info("Dynatrace agent package: %s", flavor)
 
-	s.Log.Info("dtDownloadURL=" + dtDownloadURL)
-	s.Log.BeginStep("Downloading Dynatrace agent...")
-	if err := downloadDependency(s, dtDownloadURL, dtDownloadLocalFilename); err != nil {
+	runtimes, err := profiledRuntimes(s, creds)
+	if err != nil {
+		s.Log.Error("Error selecting the .NET runtimes to profile: %s", err)
 		return err
 	}
+	s.Log.Info("Profiled .NET runtimes: %s", strings.Join(runtimes, ", "))
+	s.Installation.Runtimes = runtimes
 
-	//listExtractedFiles(s, downloadsDir)
-	s.Log.BeginStep("Extracting Dynatrace Agent to %s", dtAgentPath)
-	if err := libbuildpack.ExtractZip(dtDownloadLocalFilename, dtAgentPath); err != nil {
-		s.Log.Error("Error Extracting Dynatrace Agent", err)
+	blocklist, err := agentBlocklist(creds)
+	if err != nil {
+		s.Log.Error("Error configuring the agent blocklist: %s", err)
 		return err
 	}
+	s.Log.Info("Agent blocklist: %s", strings.Join(blocklist, ";"))
 
-	// Read tenant, tenanttoken and communications endpooint from the manifest.json file and create standalone.conf file in the agent directory
-	if err := createStandaloneFile(s, dtAgentPath); err != nil {
+	if err := validateAgentOptions(creds); err != nil {
+		s.Log.Error("Error in the agent options of the Dynatrace service: %s", err)
 		return err
 	}
+	logAgentOptions(s, creds.AgentOptions)
 
-	// Build procfile so that CF can execute the hwc command
-	if err := getProcfile(s, buildpackDir); err != nil {
+	cacheEntry := newAgentCacheEntry(s, creds, version, flavor.String())
+	if err := os.MkdirAll(cacheEntry.dir, 0755); err != nil {
+		s.Log.Error("Failed to create cache directory %s: %s", cacheEntry.dir, err)
 		return err
 	}
 
-	// Build dynatrace.bat file in profile.d directory of the app. This batch file sets all the env variables required for the agent to work
-	if err := buildProfileD(s, *creds, dtAgentPath); err != nil {
+	dtDownloadLocalFilename := cacheEntry.zipPath()
+
+	s.Log.Info("dtDownloadLocalFilename=%s", dtDownloadLocalFilename)
+
+	dtDownloadURL, err := getDownloadURL(creds, version, flavor)
+	if err != nil {
+		s.Log.Error("Error building the agent download URL: %s", err)
 		return err
 	}
 
-	s.Log.Info("Installing Dynatrace Agent Completed.")
-	return nil
+	if creds.CustomOneAgentURL != "" {
+		s.Log.Info("dtDownloadURL=%s", redact.URL(dtDownloadURL))
+	} else {
+		s.Log.Info("dtDownloadURL=%s", dtDownloadURL)
+	}
+	if cacheEntry.exists() {
+		expectedSha256, err := expectedAgentSha256(creds)
+		if err != nil {
+			s.Log.Error("Error verifying the Dynatrace agent package: %s", err)
+			return err
+		}
+		if err := verifyAgentPackage(cacheEntry.zipPath(), expectedSha256); err != nil {
+			s.Log.Warning("Discarding the cached agent package: %s", err)
+			cacheEntry.discard()
+		}
+	}
+	if version != "latest" && cacheEntry.exists() {
+		// a released agent version never changes, there is no need to ask the server again
+		s.Log.Info("Agent cache hit, version %s is already cached", version)
+	} else {
+		s.Log.BeginStep("Downloading Dynatrace agent...")
+		modified, err := downloadDependency(s, creds, dtDownloadURL, dtDownloadLocalFilename, &cacheEntry.Validators)
+		if err != nil {
+			s.Log.Error("Error downloading Dynatrace Agent: %s", err)
+			return err
+		}
+		if modified {
+			s.Log.Info("Agent cache miss, downloaded a new agent package")
+		} else {
+			s.Log.Info("Agent cache hit, the cached agent package is up to date")
+		}
+	}
+	if err := cacheEntry.save(); err != nil {
+		s.Log.Warning("Unable to update the agent cache: %s", err)
+	}
+	pruneAgentCache(s, cacheEntry)
+
+	s.Log.BeginStep("Extracting Dynatrace Agent to %s", dtAgentPath)
+	if err := libbuildpack.ExtractZip(dtDownloadLocalFilename, dtAgentPath); err != nil {
+		s.Log.Error("Error Extracting Dynatrace Agent: %s", err)
+		return err
+	}
+
+	s.Installation.Architectures = installedArchitectures(dtAgentPath)
+	if len(s.Installation.Architectures) == 0 {
+		s.Log.Error("The Dynatrace agent package does not contain oneagentloader.dll")
+		return errors.New("no profiler found in the Dynatrace agent package")
+	}
+	s.Log.Info("Installed profilers: %s bit", strings.Join(s.Installation.Architectures, " and "))
+	// finalize checks the same architectures, but it doesn't run when this buildpack is not the final one
+	if missing := missingArchitectures(s.Installation.Architectures, flavor.Bitness); len(missing) > 0 {
+		s.Log.Error("The Dynatrace agent package does not contain the %s bit profiler", strings.Join(missing, " and "))
+		return fmt.Errorf("the %s bit profiler is missing in the Dynatrace agent package, check bitness of the Dynatrace service", strings.Join(missing, " and "))
+	}
+	if installed := installedAgentVersion(dtAgentPath); installed != "" {
+		s.Log.Info("Installed agent version: %s", installed)
+		s.Installation.AgentVersion = installed
+	}
+
+	// Read tenant, tenanttoken and communications endpooint from the manifest.json file and create standalone.conf file in the agent directory
+	return createStandaloneFile(s, creds, dtAgentPath)
+}
+
+// ServiceBound reports whether the app is bound to a usable Dynatrace service. It is used by detect, which must not install
+// anything.
+func ServiceBound(log *libbuildpack.Logger) bool {
+	found, _, err := detectDynatraceServices(&Supplier{Log: log})
+	// a selection error is reported by supply, which fails the staging with the reason
+	return found || err != nil
 }
 
 // Detects whether the app is bound to a Dynatrace service or not. When an app is bound to Dynatrace service, VCAP_SERVICES env variable contains
 // entry that has dynatrace in it. If this env variable is not found, it is assumed that the app is bound to Dynatrace service.
-func detectDynatraceServices(s *Supplier) (bool, *credentials) {
+func detectDynatraceServices(s *Supplier) (bool, *credentials, error) {
 	s.Log.Info("Detecting Dynatrace...")
-	var vcapServices map[string][]struct {
-		Name        string                 `json:"name"`
-		Credentials map[string]interface{} `json:"credentials"`
-	}
-
-	if err := json.Unmarshal([]byte(os.Getenv("VCAP_SERVICES")), &vcapServices); err != nil {
+	services, err := parseVCAPServices()
+	if err != nil {
 		s.Log.Info("Failed to unmarshal VCAP_SERVICES: %s", err)
-		return false, nil
 	}
 
-	var found []*credentials
+	candidates, err := candidateServices(s, services)
+	if err != nil {
+		return false, nil, err
+	}
 
-	for _, services := range vcapServices {
-		for _, service := range services {
-			s.Log.Info("Service name is " + service.Name)
-			if !strings.Contains(strings.ToLower(service.Name), "dynatrace") {
-				continue
-			}
+	// Bound services take precedence, the environment variables are only a fallback for spaces without a Dynatrace service
+	if len(candidates) == 0 {
+		return detectEnvironmentConfiguration(s)
+	}
+	if names := configuredEnvironmentVariables(false); len(names) > 0 {
+		s.Log.Info("Ignoring %s, the Dynatrace service takes precedence", strings.Join(names, ", "))
+	}
 
-			queryString := func(key string) string {
-				if value, ok := service.Credentials[key].(string); ok {
-					return value
-				}
-				return ""
-			}
+	var found []*credentials
 
-			creds := &credentials{
-				ServiceName:       service.Name,
-				EnvironmentID:     queryString("environmentid"),
-				APIToken:          queryString("apitoken"),
-				APIURL:            queryString("apiurl"),
-				CustomOneAgentURL: queryString("customoneagenturl"),
-				SkipErrors:        queryString("skiperrors") == "true",
-				NetworkZone:       queryString("networkzone"),
-				PaasToken:         queryString("paastoken"),
-			}
+	for _, service := range candidates {
+		s.Log.Info("Service name is %s (label %s)", service.Name, service.Label)
 
-			if (creds.EnvironmentID != "" || creds.CustomOneAgentURL != "") && creds.PaasToken != "" {
-				found = append(found, creds)
-			} else if creds.EnvironmentID == "" || creds.PaasToken == "" { // One of the fields is empty.
-				s.Log.Error("Incomplete credentials. environment ID: %s, Paas Token: %s",
-					creds.EnvironmentID, creds.PaasToken)
-			}
+		creds := newCredentials(s, service.Name, service.credential)
+		if creds == nil {
+			continue
+		}
+		if err := normalizeAPIURL(s, creds); err != nil {
+			return false, nil, err
+		}
+		if creds.AgentOptions, err = service.agentOptions(); err != nil {
+			return false, nil, err
 		}
+		found = append(found, creds)
 	}
 
-	if len(found) >= 1 {
+	switch len(found) {
+	case 0:
+		return false, nil, nil
+	case 1:
 		s.Log.Info("Found one matching service: %s", found[0].ServiceName)
-		return true, found[0]
-	} else {
-		return false, nil
+		return true, found[0], nil
+	default:
+		return false, nil, ambiguousServices(found)
+	}
+}
+
+// Builds the credentials of the given source from the lookup function, which returns the setting of a credentials key. The
+// secrets are registered with the log redaction, nil is returned when the credentials are incomplete.
+func newCredentials(s *Supplier, source string, lookup func(key string) string) *credentials {
+	creds := &credentials{
+		ServiceName:       source,
+		EnvironmentID:     lookup("environmentid"),
+		APIToken:          lookup("apitoken"),
+		APIURL:            lookup("apiurl"),
+		CustomOneAgentURL: lookup("customoneagenturl"),
+		SkipErrors:        lookup("skiperrors") == "true",
+		NetworkZone:       lookup("networkzone"),
+		AgentVersion:      lookup("agentversion"),
+		AgentSha256:       lookup("agentsha256"),
+		Bitness:           lookup("bitness"),
+		Include:           lookup("include"),
+		Runtime:           lookup("runtime"),
+		PaasToken:         lookup("paastoken"),
+		Proxy:             lookup("proxy"),
+		ProxyUsername:     lookup("proxyusername"),
+		ProxyPassword:     lookup("proxypassword"),
+		CACert:            lookup("cacert"),
+		CACertFile:        lookup("cacertfile"),
+		Insecure:          lookup("insecure") == "true",
+		Blocklist:         splitBlocklist(lookup("blocklist")),
+		BlocklistMode:     lookup("blocklistmode"),
+		DeploymentEvent:   lookup("deploymentevent") == "true",
+	}
+
+	redactCredentials(s, creds)
+
+	// the API URL of Managed and ActiveGates already contains the environment
+	if (creds.EnvironmentID == "" && creds.APIURL == "" && creds.CustomOneAgentURL == "") || creds.PaasToken == "" {
+		s.Log.Error("Incomplete credentials. environment ID: %s, API URL: %s, Paas Token set: %t",
+			creds.EnvironmentID, creds.APIURL, creds.PaasToken != "")
+		return nil
+	}
+	return creds
+}
+
+// Registers the secrets of the Dynatrace service with the redacting writer of the logger so that they never show up in the
+// staging output.
+func redactCredentials(s *Supplier, creds *credentials) {
+	writer, ok := s.Log.Output().(*redact.Writer)
+	if !ok {
+		return
+	}
+
+	writer.Add(creds.PaasToken, creds.APIToken, creds.ProxyPassword)
+	if proxyURL, err := url.Parse(creds.Proxy); err == nil && proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		writer.Add(password)
+	}
+	// a repository behind customoneagenturl may expect its credentials in the user info or in the query
+	if agentURL, err := url.Parse(creds.CustomOneAgentURL); err == nil {
+		if agentURL.User != nil {
+			password, _ := agentURL.User.Password()
+			writer.Add(password)
+		}
+		for _, values := range agentURL.Query() {
+			writer.Add(values...)
+		}
 	}
 }
 
 // Creates standalone.conf file under agent/conf directory. This file contains tenant, tenanttoken and server entries. The data
 // for these entries is read from dynatrace/manifest.json file. This file is required for Paas agent.
-func createStandaloneFile(s *Supplier, dtAgentPath string) (err error) {
+func createStandaloneFile(s *Supplier, creds *credentials, dtAgentPath string) (err error) {
 	var jsonBuffer bytes.Buffer
 	manifestFile := filepath.Join(dtAgentPath, "manifest.json")
 	mFile, err := os.Open(manifestFile)
@@ -270,6 +508,9 @@ func createStandaloneFile(s *Supplier, dtAgentPath string) (err error) {
 	// Reading info from manifest file and writing few entries to the standalone.conf file
 	var tenantInfo TenantInfo
 	json.Unmarshal(byteValue, &tenantInfo)
+	if writer, ok := s.Log.Output().(*redact.Writer); ok {
+		writer.Add(tenantInfo.TenantToken)
+	}
 	//s.Log.Info("Tenant=" + tenantInfo.Tenant)
 	jsonBuffer.WriteString("tenant " + tenantInfo.Tenant + "\n")
 	jsonBuffer.WriteString("tenanttoken " + tenantInfo.TenantToken + "\n")
@@ -277,6 +518,9 @@ func createStandaloneFile(s *Supplier, dtAgentPath string) (err error) {
 	jsonBuffer.WriteString("server ")
 	endpoints := strings.Join(tenantInfo.Communications, ";")
 	jsonBuffer.WriteString(endpoints)
+	if creds.HostGroup != "" {
+		jsonBuffer.WriteString("\nhostgroup " + creds.HostGroup)
+	}
 
 	standaloneFile := path.Join(dtAgentPath, "/agent/conf/standalone.conf")
 	if err := writeToFile(&jsonBuffer, standaloneFile, 0755); err != nil {
@@ -297,72 +541,31 @@ func getBuildpackDir(s *Supplier) (string, error) {
 	return buildpackDir, err
 }
 
-// Given the url and the filepath, this function downloads Dynatrace Paas agent.
-func downloadDependency(s *Supplier, url string, filepath string) (err error) {
-	//s.Log.Info("Downloading from [%s]", url)
-	s.Log.Info("Saving to [%s]", filepath)
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	var httpClient = &http.Client{
-		Timeout:   time.Second * 100,
-		Transport: tr,
-	}
-
-	// Create the file
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	// Get the data
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("bad status: " + resp.Status)
-	}
-
-	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // Dynatrace download url can be a SaaS url or managed url. This functions look at the entries of credentials and builds the url
-func getDownloadURL(c *credentials) string {
+func getDownloadURL(c *credentials, version string, flavor agentFlavor) (string, error) {
 	if c.CustomOneAgentURL != "" {
-		return c.CustomOneAgentURL
-	}
-
-	apiURL := c.APIURL
-	if apiURL == "" {
-		apiURL = fmt.Sprintf("https://%s.live.dynatrace.com/api", c.EnvironmentID)
+		u, err := url.ParseRequestURI(c.CustomOneAgentURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("invalid customoneagenturl %s, expected http(s)://host/path", redact.URL(c.CustomOneAgentURL))
+		}
+		return c.CustomOneAgentURL, nil
 	}
 
-	u, err := url.ParseRequestURI(fmt.Sprintf("%s/v1/deployment/installer/agent/windows/paas/latest", apiURL))
+	u, err := url.ParseRequestURI(fmt.Sprintf("%s/v1/deployment/installer/agent/windows/paas/%s", apiBaseURL(c), agentVersionPath(version)))
 	if err != nil {
-		return ""
+		return "", err
 	}
 
+	// The PaaS token is sent in the Authorization header by downloadDependency, it must not be part of the URL
 	qv := make(url.Values)
-	qv.Add("Api-Token", c.PaasToken)
-	//qv.Add("bitness", "64")
+	flavor.addQuery(qv)
 	// only set the networkzone property when it is configured
 	if c.NetworkZone != "" {
 		qv.Add("networkZone", c.NetworkZone)
 	}
 	u.RawQuery = qv.Encode() // Parameters will be sorted by key.
 
-	return u.String()
+	return u.String(), nil
 }
 
 func getProcfile(s *Supplier, buildpackDir string) error {
@@ -382,14 +585,14 @@ func getProcfile(s *Supplier, buildpackDir string) error {
 		procFileDest := filepath.Join(s.Stager.BuildDir(), "Procfile")
 		procFileBundledWithBuildPackExists, err := libbuildpack.FileExists(procFileBundledWithBuildPack)
 		if err != nil {
-			s.Log.Error("Error checking if Procfile exists in buildpack", err)
+			s.Log.Error("Error checking if Procfile exists in buildpack: %s", err)
 			return err
 		}
 		if procFileBundledWithBuildPackExists {
 			// Procfile exists in buidpack folder
 			s.Log.Info("Using Procfile provided with the buildpack")
 			if err := libbuildpack.CopyFile(procFileBundledWithBuildPack, procFileDest); err != nil {
-				s.Log.Error("Error copying Procfile provided by the buildpack", err)
+				s.Log.Error("Error copying Procfile provided by the buildpack: %s", err)
 				return err
 			}
 			s.Log.Info("Copied Procfile from buildpack to app folder")
@@ -401,40 +604,73 @@ func getProcfile(s *Supplier, buildpackDir string) error {
 }
 
 func buildProfileD(s *Supplier, cred credentials, dtAgentPath string) error {
-	var scriptContentBuffer bytes.Buffer
-
 	s.Log.Info("Setting environment variables for Dynatrace .net agent")
 
-	scriptContentBuffer = setDynatraceProfilerProperties(s, dtAgentPath, cred)
-
-	scriptContent := scriptContentBuffer.String()
+	scriptContent, err := setDynatraceProfilerProperties(s, dtAgentPath, cred)
+	if err != nil {
+		s.Log.Error("Unable to build dynatrace.bat: %s", err)
+		return err
+	}
 	return s.Stager.WriteProfileD("dynatrace.bat", scriptContent)
 }
 
-func setDynatraceProfilerProperties(s *Supplier, dtAgentPath string, cred credentials) bytes.Buffer {
+func setDynatraceProfilerProperties(s *Supplier, dtAgentPath string, cred credentials) (string, error) {
 	s.Log.Info("Setting Dynatrace profiler properties")
-	var profilerSettingsBuffer bytes.Buffer
-	profilerSettingsBuffer.WriteString("set COR_ENABLE_PROFILING=1")
-	profilerSettingsBuffer.WriteString("\n")
-	profilerSettingsBuffer.WriteString("set COR_PROFILER={B7038F67-52FC-4DA2-AB02-969B3C1EDA03}")
-	profilerSettingsBuffer.WriteString("\n")
-	profilerSettingsBuffer.WriteString("set DT_AGENTACTIVE=true")
-	profilerSettingsBuffer.WriteString("\n")
-	profilerSettingsBuffer.WriteString("set DT_BLOCKLIST=powershell*")
-	profilerSettingsBuffer.WriteString("\n")
-	if cred.NetworkZone != "" {
-		profilerSettingsBuffer.WriteString("set DT_NETWORK_ZONE=" + cred.NetworkZone)
-		profilerSettingsBuffer.WriteString("\n")
-	}
-	depsDir := filepath.Join("%DEPS_DIR%", s.Stager.DepsIdx())
-	agent32bit := filepath.Join(depsDir, "dynatrace\\agent\\lib\\oneagentloader.dll")
-	agent64bit := filepath.Join(depsDir, "dynatrace\\agent\\lib64\\oneagentloader.dll")
-	profilerSettingsBuffer.WriteString(strings.Join([]string{"set COR_PROFILER_PATH_32=", agent32bit}, ""))
-	profilerSettingsBuffer.WriteString("\n")
-	profilerSettingsBuffer.WriteString(strings.Join([]string{"set COR_PROFILER_PATH_64=", agent64bit}, ""))
-	profilerSettingsBuffer.WriteString("\n")
-
-	return profilerSettingsBuffer
+	var script batchScript
+	for _, runtime := range s.Installation.Runtimes {
+		prefix := profilerVariablePrefix(runtime)
+		script.Set(prefix+"ENABLE_PROFILING", "1")
+		script.Set(prefix+"PROFILER", dynatraceProfilerGUID)
+	}
+	for _, variable := range buildpackAgentVariables(&cred) {
+		script.Set(variable.Name, variable.Value)
+	}
+	for _, name := range sortedKeys(cred.AgentOptions) {
+		script.Set(name, cred.AgentOptions[name])
+	}
+	// only reference the profilers that were actually installed, the script always runs on Windows
+	for _, runtime := range s.Installation.Runtimes {
+		for _, architecture := range installedArchitectures(dtAgentPath) {
+			agentLoader := strings.Join([]string{"", s.Stager.DepsIdx(), "dynatrace", "agent", agentLibFolder(architecture), "oneagentloader.dll"}, "\\")
+			script.SetReference(profilerVariablePrefix(runtime)+"PROFILER_PATH_"+architecture, "DEPS_DIR", agentLoader)
+		}
+	}
+
+	return script.Script()
+}
+
+// agentVariable is an agent environment variable the buildpack writes to dynatrace.bat. Setting names what configures it.
+type agentVariable struct {
+	Name    string
+	Value   string
+	Setting string
+}
+
+// Returns the agent variables the buildpack writes to dynatrace.bat for creds, variables without a value are left out.
+func buildpackAgentVariables(creds *credentials) []agentVariable {
+	// validated by installAgent
+	blocklist, _ := agentBlocklist(creds)
+	candidates := []agentVariable{
+		{"DT_AGENTACTIVE", "true", "disabled in dynatrace.yml"},
+		{"DT_BLOCKLIST", strings.Join(blocklist, ";"), "blocklist"},
+		{"DT_TAGS", strings.Join(creds.Tags, " "), "tags or cftags in dynatrace.yml"},
+		{"DT_CUSTOM_PROP", customPropertiesValue(creds.CustomProperties), "customproperties or cfcustomproperties in dynatrace.yml"},
+		{"DT_LOGLEVELCON", creds.LogLevelCon, "loglevelcon in dynatrace.yml"},
+		{"DT_LOGLEVELFILE", creds.LogLevelFile, "loglevelfile in dynatrace.yml"},
+		{"DT_NETWORK_ZONE", creds.NetworkZone, "networkzone"},
+		{"DT_RELEASE_VERSION", creds.Release.Version, "releaseversion in dynatrace.yml"},
+		{"DT_RELEASE_STAGE", creds.Release.Stage, "releasestage in dynatrace.yml"},
+		{"DT_RELEASE_PRODUCT", creds.Release.Product, "releaseproduct in dynatrace.yml"},
+		{"DT_RELEASE_BUILD_VERSION", creds.Release.BuildVersion, "releasebuildversion in dynatrace.yml"},
+	}
+
+	var variables []agentVariable
+	for _, variable := range candidates {
+		if variable.Value != "" {
+			variables = append(variables, variable)
+		}
+	}
+	return variables
 }
 
 func writeToFile(source io.Reader, destFile string, mode os.FileMode) error {
@@ -17,15 +17,1297 @@ limitations under the License.
 package supply_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"dynatrace-hwc-extension/redact"
+	"dynatrace-hwc-extension/supply"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 //go:generate mockgen -source=supply.go --destination=mocks_test.go --package=supply_test
 
+// fakeStager implements supply.Stager on top of temporary directories.
+type fakeStager struct {
+	buildDir string
+	cacheDir string
+	depsDir  string
+	depsIdx  string
+}
+
+func (f *fakeStager) BuildDir() string { return f.buildDir }
+func (f *fakeStager) DepDir() string   { return filepath.Join(f.depsDir, f.depsIdx) }
+func (f *fakeStager) DepsIdx() string  { return f.depsIdx }
+func (f *fakeStager) DepsDir() string  { return f.depsDir }
+func (f *fakeStager) CacheDir() string { return f.cacheDir }
+
+func (f *fakeStager) WriteProfileD(scriptName, scriptContents string) error {
+	profileDir := filepath.Join(f.DepDir(), "profile.d")
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(profileDir, scriptName), []byte(scriptContents), 0755)
+}
+
+func (f *fakeStager) WriteEnvFile(envVar, envVal string) error {
+	envDir := filepath.Join(f.DepDir(), "env")
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(envDir, envVar), []byte(envVal), 0644)
+}
+
+// agentZip returns a minimal Paas agent package as served by the Dynatrace deployment API, containing the profilers of the
+// given architectures (both when none is given).
+func agentZip(architectures ...string) []byte {
+	if len(architectures) == 0 {
+		architectures = []string{"32", "64"}
+	}
+	buffer := new(bytes.Buffer)
+	archive := zip.NewWriter(buffer)
+	files := map[string]string{
+		"manifest.json": `{"tenantUUID":"abc123","tenantToken":"tenant-token","communicationEndpoints":["https://abc123.live.dynatrace.com/communication"],
+			"technologies":{"dotnet":{"windows-x86-64":[{"path":"agent/lib64/oneagentloader.dll","version":"1.195.161.20200615-111543"}]}}}`,
+	}
+	for _, architecture := range architectures {
+		lib := map[string]string{"32": "lib", "64": "lib64"}[architecture]
+		files["agent/"+lib+"/oneagentloader.dll"] = architecture
+	}
+	for name, content := range files {
+		w, err := archive.Create(name)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(archive.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
 var _ = Describe("Supply", func() {
-	It("example test", func() {
-		Expect(false).To(Equal(false))
+	var (
+		rootDir  string
+		stager   *fakeStager
+		buffer   *bytes.Buffer
+		supplier *supply.Supplier
+		server   *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		rootDir, err = ioutil.TempDir("", "supply")
+		Expect(err).NotTo(HaveOccurred())
+
+		stager = &fakeStager{
+			buildDir: filepath.Join(rootDir, "build"),
+			cacheDir: filepath.Join(rootDir, "cache"),
+			depsDir:  filepath.Join(rootDir, "deps"),
+			depsIdx:  "0",
+		}
+		for _, dir := range []string{stager.buildDir, stager.DepDir(), filepath.Join(rootDir, "buildpack")} {
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		}
+		os.Setenv("BUILDPACK_DIR", filepath.Join(rootDir, "buildpack"))
+
+		buffer = new(bytes.Buffer)
+		supplier = &supply.Supplier{
+			Stager: stager,
+			Log:    libbuildpack.NewLogger(redact.NewWriter(buffer)),
+		}
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+			server = nil
+		}
+		os.Unsetenv("VCAP_SERVICES")
+		os.Unsetenv("DT_SERVICE_NAME")
+		os.Unsetenv("DT_BLOCKLIST")
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Unsetenv("DT_RELEASE_STAGE")
+		os.Unsetenv("GIT_COMMIT")
+		for _, env := range []string{"DT_ENVIRONMENT_ID", "DT_API_URL", "DT_API_TOKEN", "DT_PAAS_TOKEN", "DT_NETWORK_ZONE", "DT_CUSTOM_ONEAGENT_URL", "DT_SKIP_ERRORS"} {
+			os.Unsetenv(env)
+		}
+		os.Unsetenv("DT_DOWNLOAD_ATTEMPTS")
+		os.Unsetenv("BUILDPACK_DIR")
+		Expect(os.RemoveAll(rootDir)).To(Succeed())
+	})
+
+	bindService := func(credentials string) {
+		os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{"user-provided":[{"name":"dynatrace-service","credentials":%s}]}`, credentials))
+	}
+
+	Context("no Dynatrace service is bound", func() {
+		It("does not install the agent", func() {
+			os.Setenv("VCAP_SERVICES", `{}`)
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("No Dynatrace service to bind to"))
+			Expect(filepath.Join(stager.DepDir(), "dynatrace")).NotTo(BeADirectory())
+		})
+	})
+
+	Context("several services are bound", func() {
+		var requested string
+
+		BeforeEach(func() {
+			requested = ""
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = r.URL.Path
+				w.Write(agentZip())
+			}))
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+				"dynatrace": [{"name":"apm-prod","label":"dynatrace","tags":[],"credentials":{"customoneagenturl":"%[1]s/prod","paastoken":"token"}}],
+				"user-provided": [
+					{"name":"apm-test","label":"user-provided","tags":["Dynatrace"],"credentials":{"customoneagenturl":"%[1]s/test","paastoken":"token"}},
+					{"name":"database","label":"user-provided","tags":["mysql"],"credentials":{"uri":"mysql://db"}}
+				]
+			}`, server.URL))
+		})
+
+		It("fails and names the candidates when the choice is ambiguous", func() {
+			err := supplier.Run()
+
+			Expect(err).To(MatchError(ContainSubstring("bound to 2 Dynatrace services (apm-prod, apm-test), set DT_SERVICE_NAME")))
+			Expect(requested).To(BeEmpty())
+		})
+
+		It("uses the service selected with DT_SERVICE_NAME", func() {
+			os.Setenv("DT_SERVICE_NAME", "apm-test")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requested).To(Equal("/test"))
+		})
+
+		It("fails when DT_SERVICE_NAME does not match a bound service", func() {
+			os.Setenv("DT_SERVICE_NAME", "apm-staging")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("DT_SERVICE_NAME=apm-staging does not match any service")))
+		})
+	})
+
+	Context("a user-provided service is not named after Dynatrace", func() {
+		It("recognizes it by its credentials", func() {
+			os.Setenv("DT_DOWNLOAD_ATTEMPTS", "1")
+			os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"apm-prod","instance_name":"apm-prod","label":"user-provided","tags":[],
+				"credentials":{"apiurl":"https://127.0.0.1:1/api","paastoken":"token","skiperrors":true}}]}`)
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Found one matching service: apm-prod"))
+			Expect(supplier.Installation.SkipErrors).To(BeTrue())
+		})
+
+		It("recognizes it by its dynatrace tag", func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"apm-prod","label":"user-provided","tags":["dynatrace"],"credentials":{}}]}`)
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Service name is apm-prod (label user-provided)"))
+			Expect(buffer.String()).To(ContainSubstring("Incomplete credentials"))
+		})
+
+		It("selects it by instance name with DT_SERVICE_NAME", func() {
+			os.Setenv("DT_DOWNLOAD_ATTEMPTS", "1")
+			os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"apm","instance_name":"apm-prod","label":"user-provided","tags":[],
+				"credentials":{"environmentid":"abc123","apiurl":"https://127.0.0.1:1/api","paastoken":"token","skiperrors":"true"}}]}`)
+			os.Setenv("DT_SERVICE_NAME", "apm-prod")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Found one matching service: apm"))
+		})
+
+		It("ignores services that are unrelated to Dynatrace", func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"database","label":"user-provided","tags":["mysql"],"credentials":{"uri":"mysql://db"}}]}`)
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("No Dynatrace service to bind to..."))
+		})
+	})
+
+	Context("the agent is configured with environment variables", func() {
+		var requests int
+
+		BeforeEach(func() {
+			requests = 0
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Write(agentZip())
+			}))
+			os.Setenv("DT_CUSTOM_ONEAGENT_URL", server.URL)
+			os.Setenv("DT_PAAS_TOKEN", "env-token")
+		})
+
+		It("installs the agent when no service is bound", func() {
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requests).To(Equal(1))
+			Expect(supplier.Installation.Installed).To(BeTrue())
+			Expect(buffer.String()).To(ContainSubstring("using the environment variables DT_PAAS_TOKEN, DT_CUSTOM_ONEAGENT_URL"))
+			Expect(buffer.String()).NotTo(ContainSubstring("env-token"))
+		})
+
+		It("prefers a bound service", func() {
+			bindService(`{"environmentid":"abc123","paastoken":"token","apiurl":"https://127.0.0.1:1/api","skiperrors":"true"}`)
+			os.Setenv("DT_DOWNLOAD_ATTEMPTS", "1")
+			os.Setenv("DT_NETWORK_ZONE", "zone-1")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requests).To(Equal(0))
+			Expect(buffer.String()).To(ContainSubstring("Ignoring DT_PAAS_TOKEN, DT_CUSTOM_ONEAGENT_URL, the Dynatrace service takes precedence"))
+			Expect(buffer.String()).NotTo(ContainSubstring("Ignoring DT_NETWORK_ZONE"))
+		})
+
+		It("does not install the agent without DT_PAAS_TOKEN", func() {
+			os.Unsetenv("DT_PAAS_TOKEN")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requests).To(Equal(0))
+			Expect(buffer.String()).To(ContainSubstring("Not using the environment variables DT_CUSTOM_ONEAGENT_URL, DT_PAAS_TOKEN is not set"))
+			Expect(buffer.String()).NotTo(ContainSubstring("Incomplete credentials"))
+		})
+
+		It("leaves DT_NETWORK_ZONE alone when it is the only variable", func() {
+			os.Unsetenv("DT_PAAS_TOKEN")
+			os.Unsetenv("DT_CUSTOM_ONEAGENT_URL")
+			os.Setenv("DT_NETWORK_ZONE", "zone-1")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("No Dynatrace service to bind to"))
+			Expect(buffer.String()).NotTo(ContainSubstring("DT_NETWORK_ZONE"))
+			Expect(buffer.String()).NotTo(ContainSubstring("**ERROR**"))
+		})
+	})
+
+	Context("the tokens are validated", func() {
+		var (
+			tokens    map[string]string
+			downloads int
+		)
+
+		BeforeEach(func() {
+			downloads = 0
+			tokens = map[string]string{"paas-token": `{"enabled":true,"scopes":["InstallerDownload"]}`}
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/e/abc123/api/v2/apiTokens/lookup":
+					var lookup struct{ Token string }
+					Expect(json.NewDecoder(r.Body).Decode(&lookup)).To(Succeed())
+					Expect(r.Header.Get("Authorization")).To(Equal("Api-Token " + lookup.Token))
+					info, ok := tokens[lookup.Token]
+					if !ok {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.Write([]byte(info))
+				case "/e/abc123/api/v2/events/ingest":
+					w.WriteHeader(http.StatusCreated)
+				case "/e/abc123/api/v1/deployment/installer/agent/windows/paas/latest/metainfo":
+					w.Write([]byte(`{"latestAgentVersion":"1.197.10.20200701-080000"}`))
+				default:
+					downloads++
+					w.Write(agentZip())
+				}
+			}))
+		})
+
+		bind := func(paasToken string) {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"%s","apitoken":"api-token","deploymentevent":"true"}`,
+				server.URL, paasToken))
+		}
+
+		It("downloads the agent with a valid paastoken", func() {
+			bind("paas-token")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(downloads).To(Equal(1))
+			Expect(buffer.String()).To(ContainSubstring("paastoken has the InstallerDownload scope"))
+		})
+
+		It("rejects an unknown paastoken before downloading", func() {
+			bind("wrong-token")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("paastoken is not a valid token of the Dynatrace environment")))
+			Expect(downloads).To(BeZero())
+		})
+
+		It("rejects a paastoken without the InstallerDownload scope", func() {
+			tokens["paas-token"] = `{"enabled":true,"scopes":["DataExport"]}`
+			bind("paas-token")
+
+			Expect(supplier.Run()).To(MatchError("paastoken is missing the InstallerDownload scope, fix paastoken"))
+			Expect(downloads).To(BeZero())
+		})
+
+		It("rejects a revoked or expired paastoken", func() {
+			tokens["paas-token"] = `{"enabled":false,"scopes":["InstallerDownload"]}`
+			bind("paas-token")
+			Expect(supplier.Run()).To(MatchError("paastoken is revoked, fix paastoken"))
+
+			tokens["paas-token"] = `{"enabled":true,"expirationDate":"2020-06-30T10:00:00Z","scopes":["InstallerDownload"]}`
+			Expect(supplier.Run()).To(MatchError("paastoken expired on 2020-06-30, fix paastoken"))
+		})
+
+		It("names the environment variable when the agent is configured from the environment", func() {
+			os.Setenv("DT_API_URL", server.URL+"/e/abc123/api")
+			os.Setenv("DT_PAAS_TOKEN", "wrong-token")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("check DT_PAAS_TOKEN")))
+		})
+
+		It("warns when the apitoken can't send the deployment event", func() {
+			tokens["api-token"] = `{"enabled":true,"scopes":["ReadConfig"]}`
+			bind("paas-token")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("apitoken is missing the events.ingest scope, the deployment event will not be sent"))
+		})
+	})
+
+	Context("the agent download fails", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+		})
+
+		It("fails the staging", func() {
+			os.Setenv("DT_DOWNLOAD_ATTEMPTS", "1")
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).NotTo(Succeed())
+			Expect(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat")).NotTo(BeAnExistingFile())
+		})
+
+		Context("skiperrors is set", func() {
+			It("continues staging without the agent", func() {
+				os.Setenv("DT_DOWNLOAD_ATTEMPTS", "1")
+				bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","skiperrors":"true"}`, server.URL))
+
+				Expect(supplier.Run()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("continuing without the agent"))
+				Expect(filepath.Join(stager.DepDir(), "dynatrace")).NotTo(BeADirectory())
+				Expect(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat")).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("the agent download is retried", func() {
+		var requests int
+
+		BeforeEach(func() {
+			requests = 0
+		})
+
+		It("honors Retry-After and installs the agent once the server recovers", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requests).To(Equal(2))
+			Expect(buffer.String()).To(ContainSubstring("Download attempt 1 failed: bad status: 503"))
+			Expect(filepath.Join(stager.DepDir(), "dynatrace", "agent", "conf", "standalone.conf")).To(BeAnExistingFile())
+		})
+
+		It("does not retry when the token is rejected", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			err := supplier.Run()
+			Expect(err).To(MatchError(ContainSubstring("check the paastoken")))
+			Expect(requests).To(Equal(1))
+		})
+
+		It("does not retry an invalid agentsha256", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentsha256":"not-a-checksum"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError("invalid agentsha256 not-a-checksum, expected 64 hexadecimal characters"))
+			Expect(requests).To(BeZero())
+			Expect(buffer.String()).NotTo(ContainSubstring("Retrying"))
+		})
+
+		It("does not retry an invalid customoneagenturl", func() {
+			bindService(`{"customoneagenturl":"dynatrace.example.com/agent.zip","paastoken":"token"}`)
+
+			Expect(supplier.Run()).To(MatchError("invalid customoneagenturl dynatrace.example.com/agent.zip, expected http(s)://host/path"))
+			Expect(buffer.String()).NotTo(ContainSubstring("Download attempt"))
+		})
+	})
+
+	Context("the apiurl is not normalized", func() {
+		It("adds the environment to a Managed apiurl", func() {
+			var requested string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = r.URL.Path
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring(fmt.Sprintf("Using apiurl %s/e/abc123/api instead of %s/", server.URL, server.URL)))
+			Expect(requested).To(Equal("/e/abc123/api/v1/deployment/installer/agent/windows/paas/latest"))
+			Expect(supplier.Installation.AgentVersion).To(Equal("1.195.161.20200615-111543"))
+			Expect(buffer.String()).To(ContainSubstring("Installed agent version: 1.195.161.20200615-111543"))
+		})
+
+		It("rejects a malformed apiurl", func() {
+			os.Setenv("DT_API_URL", "https://xyz789.live.dynatrace.com/api")
+			os.Setenv("DT_ENVIRONMENT_ID", "abc123")
+			os.Setenv("DT_PAAS_TOKEN", "token")
+
+			Expect(supplier.Run()).To(MatchError("invalid DT_API_URL https://xyz789.live.dynatrace.com/api: it belongs to the environment xyz789, not to abc123"))
+		})
+	})
+
+	Context("the Dynatrace API returns an error", func() {
+		respond := func(status int, body string) {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				w.Write([]byte(body))
+			}))
+		}
+
+		BeforeEach(func() {
+			os.Setenv("DT_DOWNLOAD_ATTEMPTS", "1")
+		})
+
+		It("explains an unknown environment", func() {
+			respond(http.StatusNotFound, `{"error":{"code":404,"message":"Environment abc not found"}}`)
+			bindService(fmt.Sprintf(`{"environmentid":"abc","apiurl":"%s/e/abc/api","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError("bad status: 404 Not Found: Environment abc not found (the Dynatrace environment does not exist, check the environmentid of the Dynatrace service)"))
+		})
+
+		It("explains a Managed apiurl without the environment", func() {
+			respond(http.StatusNotFound, "")
+			bindService(fmt.Sprintf(`{"apiurl":"%s/api","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("must have the form https://<host>/e/<environmentid>/api")))
+		})
+
+		It("explains an unknown network zone", func() {
+			respond(http.StatusBadRequest, `{"error":{"code":400,"message":"Constraints violated.","constraintViolations":[{"path":"networkZone","message":"Network zone not found","parameterLocation":"QUERY"}]}}`)
+			bindService(fmt.Sprintf(`{"environmentid":"abc","apiurl":"%s/e/abc/api","paastoken":"token","networkzone":"nowhere"}`, server.URL))
+
+			err := supplier.Run()
+			Expect(err).To(MatchError(ContainSubstring("Constraints violated. [networkZone: Network zone not found]")))
+			Expect(err).To(MatchError(ContainSubstring("check networkzone of the Dynatrace service")))
+		})
+
+		It("explains rate limiting", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("Dynatrace is rate limiting the requests")))
+		})
+	})
+
+	Context("a proxy is configured in the Dynatrace service", func() {
+		It("downloads the agent through the proxy with basic auth", func() {
+			var proxiedHost, proxyAuth string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxiedHost = r.URL.Host
+				proxyAuth = r.Header.Get("Proxy-Authorization")
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"http://dynatrace.example.invalid/agent.zip","paastoken":"token","proxy":"%s","proxyusername":"user","proxypassword":"secret"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(proxiedHost).To(Equal("dynatrace.example.invalid"))
+			Expect(proxyAuth).To(HavePrefix("Basic "))
+			Expect(buffer.String()).NotTo(ContainSubstring("secret"))
+		})
+
+		It("rejects a malformed proxy", func() {
+			bindService(`{"customoneagenturl":"http://dynatrace.example.invalid/agent.zip","paastoken":"token","proxy":"proxy.example.invalid:8080"}`)
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid proxy")))
+		})
+	})
+
+	Context("the agent is served over TLS", func() {
+		var caPEM string
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+			caPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+		})
+
+		bindTLSService := func(extra string) {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"%s}`, server.URL, extra))
+		}
+
+		It("rejects an untrusted certificate without retrying", func() {
+			bindTLSService("")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("add its CA with cacert or cacertfile")))
+			Expect(buffer.String()).NotTo(ContainSubstring("Download attempt 2"))
+		})
+
+		It("trusts the CA given inline with cacert", func() {
+			ca, err := json.Marshal(caPEM)
+			Expect(err).NotTo(HaveOccurred())
+			bindTLSService(`,"cacert":` + string(ca))
+
+			Expect(supplier.Run()).To(Succeed())
+		})
+
+		It("trusts the CA given as a file of the app with cacertfile", func() {
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace-ca.pem"), []byte(caPEM), 0644)).To(Succeed())
+			bindTLSService(`,"cacertfile":"dynatrace-ca.pem"`)
+
+			Expect(supplier.Run()).To(Succeed())
+		})
+
+		It("skips verification when insecure is set and warns about it", func() {
+			bindTLSService(`,"insecure":"true"`)
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("TLS certificate verification is DISABLED"))
+		})
+
+		It("warns about insecure only once per staging", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","insecure":"true"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(strings.Count(buffer.String(), "TLS certificate verification is DISABLED")).To(Equal(1))
+		})
+	})
+
+	Context("the agent is downloaded from the deployment API", func() {
+		It("sends the PaaS token in the Authorization header and keeps it out of the log", func() {
+			var authorization, query string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+				query = r.URL.RawQuery
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"dt0c01.PAAS","apitoken":"dt0c01.API","networkzone":"zone"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(authorization).To(Equal("Api-Token dt0c01.PAAS"))
+			Expect(query).To(Equal("networkZone=zone"))
+			Expect(buffer.String()).NotTo(ContainSubstring("dt0c01"))
+			Expect(buffer.String()).NotTo(ContainSubstring("tenant-token"))
+		})
+	})
+
+	Context("the agent package is cached", func() {
+		It("revalidates the cached package with the ETag of the previous download", func() {
+			var requests int
+			var ifNoneMatch string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				ifNoneMatch = r.Header.Get("If-None-Match")
+				if ifNoneMatch == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Agent cache miss"))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requests).To(Equal(2))
+			Expect(ifNoneMatch).To(Equal(`"v1"`))
+			Expect(buffer.String()).To(ContainSubstring("Agent cache hit"))
+			Expect(filepath.Join(stager.DepDir(), "dynatrace", "agent", "conf", "standalone.conf")).To(BeAnExistingFile())
+		})
+
+		It("caches the latest agent by its version", func() {
+			var paths []string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				if strings.HasSuffix(r.URL.Path, "/latest/metainfo") {
+					w.Write([]byte(`{"latestAgentVersion":"1.197.10.20200701-080000"}`))
+					return
+				}
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.Run()).To(Succeed())
+			Expect(paths).To(Equal([]string{
+				"/e/abc123/api/v2/apiTokens/lookup",
+				"/e/abc123/api/v1/deployment/installer/agent/windows/paas/latest/metainfo",
+				"/e/abc123/api/v1/deployment/installer/agent/windows/paas/version/1.197.10.20200701-080000",
+				"/e/abc123/api/v2/apiTokens/lookup",
+				"/e/abc123/api/v1/deployment/installer/agent/windows/paas/latest/metainfo",
+			}))
+			Expect(buffer.String()).To(ContainSubstring("Latest agent version resolved to 1.197.10.20200701-080000"))
+			Expect(buffer.String()).To(ContainSubstring("Agent cache hit, version 1.197.10.20200701-080000 is already cached"))
+		})
+
+		It("revalidates the latest agent when its version can't be looked up", func() {
+			var ifNoneMatch string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/latest/metainfo") {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if !strings.HasSuffix(r.URL.Path, "/paas/latest") {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				ifNoneMatch = r.Header.Get("If-None-Match")
+				if ifNoneMatch == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.Run()).To(Succeed())
+			Expect(ifNoneMatch).To(Equal(`"v1"`))
+			Expect(buffer.String()).To(ContainSubstring("Unable to look up the latest agent version, continuing with latest"))
+			Expect(buffer.String()).To(ContainSubstring("Agent cache hit, the cached agent package is up to date"))
+		})
+
+		It("keeps the credentials of customoneagenturl out of the staging log and the cache", func() {
+			var authorization, token string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+				token = r.URL.Query().Get("token")
+				w.Write(agentZip())
+			}))
+			agentURL := strings.Replace(server.URL, "http://", "http://user:s3cr3t@", 1) + "/agent.zip?token=abc123xyz"
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, agentURL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(authorization).NotTo(BeEmpty())
+			Expect(token).To(Equal("abc123xyz"))
+			Expect(buffer.String()).To(ContainSubstring("dtDownloadURL=" + server.URL + "/agent.zip\n"))
+			Expect(buffer.String()).NotTo(ContainSubstring("s3cr3t"))
+			Expect(buffer.String()).NotTo(ContainSubstring("abc123xyz"))
+
+			entries, err := filepath.Glob(filepath.Join(stager.cacheDir, "dynatrace", "*", "entry.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			entry, err := ioutil.ReadFile(entries[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(entry)).NotTo(ContainSubstring("s3cr3t"))
+			Expect(string(entry)).NotTo(ContainSubstring("abc123xyz"))
+		})
+
+		It("keeps a bounded number of packages", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+			for _, zone := range []string{"a", "b", "c", "d"} {
+				bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","networkzone":"%s"}`, server.URL, zone))
+				Expect(supplier.Run()).To(Succeed())
+			}
+
+			entries, err := ioutil.ReadDir(filepath.Join(stager.cacheDir, "dynatrace"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(3))
+		})
+	})
+
+	Context("an agent version is pinned", func() {
+		var paths []string
+
+		BeforeEach(func() {
+			paths = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				if r.URL.Path == "/e/abc123/api/v1/deployment/installer/agent/versions/windows/paas" {
+					w.Write([]byte(`{"availableVersions":["1.195.150.20200601-100000","1.195.161.20200615-111543","1.197.10.20200701-080000"]}`))
+					return
+				}
+				w.Write(agentZip())
+			}))
+		})
+
+		It("downloads the newest version matching the pinned prefix and records it", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","agentversion":"1.195"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(paths).To(ContainElement("/e/abc123/api/v1/deployment/installer/agent/windows/paas/version/1.195.161.20200615-111543"))
+			Expect(supplier.Installation.AgentVersion).To(Equal("1.195.161.20200615-111543"))
+			Expect(buffer.String()).To(ContainSubstring("Dynatrace agent version: 1.195.161.20200615-111543"))
+		})
+
+		It("reuses the cached package of the pinned version", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","agentversion":"1.197.10.20200701-080000"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.Run()).To(Succeed())
+			Expect(paths).To(Equal([]string{
+				"/e/abc123/api/v2/apiTokens/lookup",
+				"/e/abc123/api/v1/deployment/installer/agent/versions/windows/paas",
+				"/e/abc123/api/v1/deployment/installer/agent/windows/paas/version/1.197.10.20200701-080000",
+				"/e/abc123/api/v2/apiTokens/lookup",
+				"/e/abc123/api/v1/deployment/installer/agent/versions/windows/paas",
+			}))
+		})
+
+		It("drops the agentsha256 of the service when dynatrace.yml pins another version", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","agentversion":"1.195","agentsha256":"%064d"}`, server.URL, 0))
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte("agentversion: 1.197\n"), 0644)).To(Succeed())
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(paths).To(ContainElement("/e/abc123/api/v1/deployment/installer/agent/windows/paas/version/1.197.10.20200701-080000"))
+			Expect(buffer.String()).To(ContainSubstring("Ignoring agentsha256 from dynatrace-service, it does not belong to agentversion 1.197 from dynatrace.yml"))
+		})
+
+		It("verifies the version pinned in dynatrace.yml with its agentsha256 and does not retry a mismatch", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","agentversion":"1.195"}`, server.URL))
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte(fmt.Sprintf("agentversion: 1.197\nagentsha256: %064d\n", 0)), 0644)).To(Succeed())
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("the agent package does not match agentsha256")))
+			Expect(paths).To(Equal([]string{
+				"/e/abc123/api/v2/apiTokens/lookup",
+				"/e/abc123/api/v1/deployment/installer/agent/versions/windows/paas",
+				"/e/abc123/api/v1/deployment/installer/agent/windows/paas/version/1.197.10.20200701-080000",
+			}))
+		})
+
+		It("rejects a version that is not available", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","agentversion":"1.180"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("agentversion 1.180 is not available")))
+		})
+	})
+
+	Context("bitness and include are set", func() {
+		It("downloads the selected flavor and only references the installed profiler", func() {
+			var query string
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				w.Write(agentZip("64"))
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","bitness":"64","include":"dotnet, php"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(query).To(Equal("bitness=64&include=dotnet&include=php"))
+			Expect(supplier.Installation.Architectures).To(Equal([]string{"64"}))
+			Expect(supplier.Installation.Bitness).To(Equal("64"))
+
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(ContainSubstring("COR_PROFILER_PATH_64="))
+			Expect(string(script)).NotTo(ContainSubstring("COR_PROFILER_PATH_32"))
+		})
+
+		It("reports a package without the profiler of the configured bitness", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip("64"))
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError("the 32 bit profiler is missing in the Dynatrace agent package, check bitness of the Dynatrace service"))
+
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","skiperrors":"true"}`, server.URL))
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.Installation.Installed).To(BeFalse())
+			Expect(buffer.String()).To(ContainSubstring("continuing without the agent because skiperrors is set: the 32 bit profiler is missing"))
+			Expect(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat")).NotTo(BeAnExistingFile())
+		})
+
+		It("rejects an invalid bitness", func() {
+			bindService(`{"environmentid":"abc123","paastoken":"token","bitness":"16"}`)
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid bitness 16")))
+		})
+	})
+
+	Context("the app runs on .NET Core", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "app.runtimeconfig.json"), []byte(`{}`), 0644)).To(Succeed())
+		})
+
+		It("sets the CORECLR profiler variables next to the COR ones", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.Installation.Runtimes).To(Equal([]string{"framework", "core"}))
+
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(ContainSubstring("set \"COR_ENABLE_PROFILING=1\"\r\n"))
+			Expect(string(script)).To(ContainSubstring("set \"CORECLR_ENABLE_PROFILING=1\"\r\n"))
+			Expect(string(script)).To(ContainSubstring("set \"CORECLR_PROFILER={B7038F67-52FC-4DA2-AB02-969B3C1EDA03}\"\r\n"))
+			Expect(string(script)).To(ContainSubstring(`set "CORECLR_PROFILER_PATH_32=`))
+			Expect(string(script)).To(ContainSubstring(`set "CORECLR_PROFILER_PATH_64=`))
+		})
+
+		It("only profiles the runtime selected with runtime", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","runtime":"framework"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(ContainSubstring("COR_PROFILER_PATH_64="))
+			Expect(string(script)).NotTo(ContainSubstring("CORECLR_"))
+		})
+
+		It("rejects an invalid runtime", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","runtime":"mono"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid runtime mono")))
+		})
+	})
+
+	Context("the app has a Dynatrace configuration file", func() {
+		var query string
+
+		BeforeEach(func() {
+			query = ""
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				w.Write(agentZip("64"))
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"token","bitness":"all"}`, server.URL))
+		})
+
+		writeConfig := func(name, content string) {
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, name), []byte(content), 0644)).To(Succeed())
+		}
+
+		It("merges dynatrace.yml over the service credentials", func() {
+			writeConfig("dynatrace.yml", `
+bitness: 64
+blocklist: [w3wp-warmup*]
+hostgroup: payments_prod
+tags: [team=payments, frontend]
+customproperties:
+  stage: prod
+  costcenter: "1234"
+loglevelfile: Debug
+`)
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(query).To(Equal("bitness=64"))
+			Expect(buffer.String()).To(ContainSubstring("Using bitness 64 from dynatrace.yml instead of all from dynatrace-service"))
+
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(ContainSubstring("set \"DT_BLOCKLIST=powershell*;w3wp-warmup*\"\r\n"))
+			Expect(string(script)).To(ContainSubstring("set \"DT_TAGS=team=payments frontend\"\r\n"))
+			Expect(string(script)).To(ContainSubstring("set \"DT_CUSTOM_PROP=costcenter=1234 stage=prod\"\r\n"))
+			Expect(string(script)).To(ContainSubstring("set \"DT_LOGLEVELFILE=debug\"\r\n"))
+
+			conf, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "dynatrace", "agent", "conf", "standalone.conf"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(conf)).To(ContainSubstring("\nhostgroup payments_prod"))
+		})
+
+		It("reads the dynatrace section of buildpack.yml", func() {
+			writeConfig("buildpack.yml", "hwc:\n  version: 1\ndynatrace:\n  bitness: 64\n")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(query).To(Equal("bitness=64"))
+			Expect(buffer.String()).To(ContainSubstring("from buildpack.yml"))
+		})
+
+		It("prefers dynatrace.yml over buildpack.yml", func() {
+			writeConfig("dynatrace.yml", "bitness: 64\n")
+			writeConfig("buildpack.yml", "dynatrace:\n  bitness: 32\n")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(query).To(Equal("bitness=64"))
+			Expect(buffer.String()).To(ContainSubstring("Ignoring the dynatrace section of buildpack.yml, dynatrace.yml takes precedence"))
+		})
+
+		It("does not install the agent when it is disabled", func() {
+			writeConfig("dynatrace.yml", "disabled: true\n")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(query).To(BeEmpty())
+			Expect(supplier.Installation.Installed).To(BeFalse())
+		})
+
+		It("reports unknown keys", func() {
+			writeConfig("dynatrace.yml", "hostgroups: payments\nbitness: 64\n")
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Ignoring unknown keys in dynatrace.yml: hostgroups"))
+		})
+
+		It("rejects values of the wrong type", func() {
+			writeConfig("dynatrace.yml", "tags: frontend\n")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid dynatrace.yml")))
+		})
+
+		It("rejects an invalid host group", func() {
+			writeConfig("dynatrace.yml", "hostgroup: dt.payments\n")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("hostgroup \"dt.payments\"")))
+		})
+	})
+
+	Context("the agent blocklist is configured", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+		})
+
+		blocklist := func() string {
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			for _, line := range strings.Split(string(script), "\r\n") {
+				if strings.HasPrefix(line, `set "DT_BLOCKLIST=`) {
+					return strings.TrimSuffix(strings.TrimPrefix(line, `set "DT_BLOCKLIST=`), `"`)
+				}
+			}
+			return ""
+		}
+
+		It("appends the patterns of the credentials to the default ones", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","blocklist":"reportgen*, pdf-*"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(blocklist()).To(Equal("powershell*;reportgen*;pdf-*"))
+		})
+
+		It("replaces the default patterns with the ones of dynatrace.yml", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","blocklist":"reportgen*"}`, server.URL))
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte("blocklistmode: replace\nblocklist: [pdf-*]\n"), 0644)).To(Succeed())
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(blocklist()).To(Equal("pdf-*"))
+		})
+
+		It("keeps the DT_BLOCKLIST of the app and removes duplicates", func() {
+			os.Setenv("DT_BLOCKLIST", "PowerShell*;cleanup.exe")
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","blocklist":"cleanup.exe;reportgen*"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(blocklist()).To(Equal("PowerShell*;cleanup.exe;reportgen*"))
+		})
+
+		It("does not set a blocklist when it is cleared", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","blocklistmode":"clear"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(blocklist()).To(BeEmpty())
+		})
+
+		It("rejects an invalid mode", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","blocklistmode":"merge"}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid blocklistmode merge")))
+		})
+	})
+
+	Context("agent options are set in the Dynatrace service", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+		})
+
+		It("exports the DT_ credentials and the agentoptions to dynatrace.bat", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","DT_LOGLEVELCON":"info",
+				"DT_CONNECTION_POINT":"https://ag1:9999/communication;https://ag2:9999/communication",
+				"agentoptions":{"DT_PROXY_TOKEN":"s3cret","DT_MY_FLAG":"a&b %%PATH%%","DT_LOGLEVELCON":"debug"}}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(ContainSubstring(`set "DT_CONNECTION_POINT=https://ag1:9999/communication;https://ag2:9999/communication"`))
+			Expect(string(script)).To(ContainSubstring(`set "DT_LOGLEVELCON=debug"`))
+			Expect(string(script)).To(ContainSubstring(`set "DT_MY_FLAG=a&b %%PATH%%"`))
+			Expect(string(script)).To(ContainSubstring(`set "DT_PROXY_TOKEN=s3cret"`))
+
+			Expect(buffer.String()).To(ContainSubstring("Setting agent option DT_PROXY_TOKEN=****"))
+			Expect(buffer.String()).To(ContainSubstring("Setting agent option DT_MY_FLAG=a&b %PATH%"))
+			Expect(buffer.String()).NotTo(ContainSubstring("s3cret"))
+		})
+
+		It("accepts agentoptions encoded as a JSON string", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentoptions":"{\"DT_LOGLEVELFILE\":\"debug\"}"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Setting agent option DT_LOGLEVELFILE=debug"))
+		})
+
+		It("rejects invalid option names", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentoptions":{"DT LOGLEVEL":"debug"}}`, server.URL))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring(`invalid agent option name "DT LOGLEVEL"`)))
+		})
+
+		It("does not let the options override the profiler or the environment of the app", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentoptions":{"COR_ENABLE_PROFILING":"0"}}`, server.URL))
+			Expect(supplier.Run()).To(MatchError("agent option COR_ENABLE_PROFILING is not a Dynatrace agent setting, only names starting with DT_ are allowed"))
+
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentoptions":{"DEPS_DIR":"C:\\evil"}}`, server.URL))
+			Expect(supplier.Run()).To(MatchError("agent option DEPS_DIR is not a Dynatrace agent setting, only names starting with DT_ are allowed"))
+
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentoptions":"{\"PATH\":\"x\"}"}`, server.URL))
+			Expect(supplier.Run()).To(MatchError("agent option PATH is not a Dynatrace agent setting, only names starting with DT_ are allowed"))
+			Expect(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat")).NotTo(BeAnExistingFile())
+		})
+
+		It("exports DT_ credentials regardless of their case", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","dt_loglevelfile":"debug"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Setting agent option dt_loglevelfile=debug"))
+		})
+
+		It("does not let the options replace the variables the buildpack merged", func() {
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","blocklist":"reportgen*","DT_BLOCKLIST":"foo*"}`, server.URL))
+			Expect(supplier.Run()).To(MatchError("agent option DT_BLOCKLIST is set by the buildpack, use blocklist instead"))
+
+			os.Setenv("VCAP_APPLICATION", `{"application_name":"payments","application_id":"5b1c4f0e","space_name":"prod","organization_name":"acme"}`)
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentoptions":{"dt_tags":"x=y"}}`, server.URL))
+			Expect(supplier.Run()).To(MatchError("agent option dt_tags is set by the buildpack, use tags or cftags in dynatrace.yml instead"))
+			Expect(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("the app runs in Cloud Foundry", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+			os.Setenv("VCAP_APPLICATION", `{"application_name":"payments api","application_id":"5b1c4f0e-1c1a-4a36-a9a4-0a3d0b7d4c11",
+				"space_name":"prod","space_id":"b2a1","organization_name":"acme&co","organization_id":"o1","application_version":"9e4b7c1d"}`)
+		})
+
+		readScript := func() string {
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			return string(script)
+		}
+
+		It("reports the org, space, app and app GUID", func() {
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(readScript()).To(ContainSubstring("set \"DT_TAGS=cf-org=acme_co cf-space=prod cf-app=payments_api\"\r\n"))
+			Expect(readScript()).To(ContainSubstring("set \"DT_CUSTOM_PROP=cf-app-guid=5b1c4f0e-1c1a-4a36-a9a4-0a3d0b7d4c11\"\r\n"))
+		})
+
+		It("uses the templates of dynatrace.yml and keeps the settings of the app", func() {
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte(`
+tags: [team=payments]
+customproperties: {stage: live}
+cftags: ["app={application_name}"]
+cfcustomproperties: {stage: "{space_name}", space: "{space_name}"}
+cfhostgroup: "{organization_name}_{space_name}"
+`), 0644)).To(Succeed())
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(readScript()).To(ContainSubstring("set \"DT_TAGS=team=payments app=payments_api\"\r\n"))
+			Expect(readScript()).To(ContainSubstring("set \"DT_CUSTOM_PROP=space=prod stage=live\"\r\n"))
+			conf, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "dynatrace", "agent", "conf", "standalone.conf"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(conf)).To(ContainSubstring("\nhostgroup acme_co_prod"))
+		})
+
+		It("reports every push as a release", func() {
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(readScript()).To(ContainSubstring("set \"DT_RELEASE_VERSION=9e4b7c1d\"\r\n"))
+			Expect(readScript()).To(ContainSubstring("set \"DT_RELEASE_STAGE=prod\"\r\n"))
+			Expect(readScript()).To(ContainSubstring("set \"DT_RELEASE_PRODUCT=payments api\"\r\n"))
+			Expect(readScript()).NotTo(ContainSubstring("DT_RELEASE_BUILD_VERSION"))
+		})
+
+		It("prefers the release metadata of dynatrace.yml and of the environment", func() {
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte("releaseversion: 2.4.1\nreleasebuildversion: \"1234\"\n"), 0644)).To(Succeed())
+			os.Setenv("DT_RELEASE_STAGE", "blue")
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(readScript()).To(ContainSubstring("set \"DT_RELEASE_VERSION=2.4.1\"\r\n"))
+			Expect(readScript()).To(ContainSubstring("set \"DT_RELEASE_STAGE=blue\"\r\n"))
+			Expect(readScript()).To(ContainSubstring("set \"DT_RELEASE_BUILD_VERSION=1234\"\r\n"))
+			Expect(buffer.String()).To(ContainSubstring("version 2.4.1 (from dynatrace.yml), stage blue (from DT_RELEASE_STAGE), product payments api (from VCAP_APPLICATION)"))
+		})
+
+		It("can be turned off", func() {
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte("cfmetadata: false\n"), 0644)).To(Succeed())
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(readScript()).NotTo(ContainSubstring("DT_TAGS"))
+		})
+
+		It("rejects unknown placeholders", func() {
+			Expect(ioutil.WriteFile(filepath.Join(stager.buildDir, "dynatrace.yml"), []byte("cftags: [\"{app}\"]\n"), 0644)).To(Succeed())
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("unknown placeholder {app}")))
+		})
+	})
+
+	Context("the app opted in to the deployment event", func() {
+		var (
+			status int
+			header http.Header
+			event  map[string]interface{}
+		)
+
+		BeforeEach(func() {
+			status, header, event = http.StatusCreated, nil, nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/e/abc123/api/v2/events/ingest":
+					Expect(r.Method).To(Equal(http.MethodPost))
+					header = r.Header
+					Expect(json.NewDecoder(r.Body).Decode(&event)).To(Succeed())
+					w.WriteHeader(status)
+				case "/e/abc123/api/v2/apiTokens/lookup":
+					w.Write([]byte(`{"enabled":true,"scopes":["InstallerDownload","events.ingest"]}`))
+				default:
+					w.Write(agentZip())
+				}
+			}))
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"paas-token","apitoken":"api-token","deploymentevent":"true"}`, server.URL))
+			os.Setenv("VCAP_APPLICATION", `{"application_name":"payments api","application_id":"5b1c4f0e-1c1a-4a36-a9a4-0a3d0b7d4c11",
+				"space_name":"prod","space_id":"b2a1","organization_name":"acme&co","organization_id":"o1","application_version":"9e4b7c1d"}`)
+		})
+
+		It("posts a CUSTOM_DEPLOYMENT event with the API token", func() {
+			Expect(ioutil.WriteFile(filepath.Join(rootDir, "buildpack", "VERSION"), []byte("0.6\n"), 0644)).To(Succeed())
+			os.Setenv("GIT_COMMIT", "8f2e1d0")
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(header.Get("Authorization")).To(Equal("Api-Token api-token"))
+			Expect(event).To(HaveKeyWithValue("eventType", "CUSTOM_DEPLOYMENT"))
+			Expect(event).To(HaveKeyWithValue("title", "Cloud Foundry deployment of payments api"))
+			Expect(event).To(HaveKeyWithValue("entitySelector", `type(PROCESS_GROUP_INSTANCE),tag("[Environment]cf-org:acme_co"),tag("[Environment]cf-space:prod"),tag("[Environment]cf-app:payments_api")`))
+			properties, ok := event["properties"].(map[string]interface{})
+			Expect(ok).To(BeTrue())
+			Expect(properties).To(HaveKeyWithValue("cf.application.id", "5b1c4f0e-1c1a-4a36-a9a4-0a3d0b7d4c11"))
+			Expect(properties).To(HaveKeyWithValue("cf.space.name", "prod"))
+			Expect(properties).To(HaveKeyWithValue("cf.organization.name", "acme&co"))
+			Expect(properties).To(HaveKeyWithValue("dt.event.deployment.version", "9e4b7c1d"))
+			Expect(properties).To(HaveKeyWithValue("buildpack.version", "0.6"))
+			Expect(properties).To(HaveKeyWithValue("agent.version", "1.195.161.20200615-111543"))
+			Expect(properties).To(HaveKeyWithValue("git.commit", "8f2e1d0"))
+			Expect(buffer.String()).To(ContainSubstring("Sent the deployment event to Dynatrace"))
+			Expect(buffer.String()).NotTo(ContainSubstring("api-token"))
+		})
+
+		It("does not fail the staging when the event is rejected", func() {
+			status = http.StatusInternalServerError
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.Installation.Installed).To(BeTrue())
+			Expect(buffer.String()).To(ContainSubstring("Unable to send the deployment event to Dynatrace: bad status: 500"))
+		})
+
+		It("does not send the event without an API token", func() {
+			bindService(fmt.Sprintf(`{"environmentid":"abc123","apiurl":"%s/e/abc123/api","paastoken":"paas-token","deploymentevent":"true"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(event).To(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("Not sending the deployment event, apitoken is not set"))
+		})
+	})
+
+	Context("dynatrace.bat is generated", func() {
+		It("matches the golden file", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","networkzone":"emea&prod","runtime":"all",
+				"blocklist":"report gen*","agentoptions":{"DT_CONNECTION_POINT":"https://ag:9999/communication;https://ag2:9999/communication","DT_RUN_HINT":"%%TEMP%%\\a \"b\" | c"}}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			script, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			golden, err := ioutil.ReadFile(filepath.Join("testdata", "dynatrace.bat"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(Equal(string(golden)))
+		})
+	})
+
+	Context("the downloaded package is verified", func() {
+		It("discards an HTML error page and downloads again", func() {
+			var requests int
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.Write([]byte("<!DOCTYPE html><html><body>Please log in</body></html>"))
+					return
+				}
+				w.Write(agentZip())
+			}))
+			os.Setenv("DT_DOWNLOAD_ATTEMPTS", "2")
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token"}`, server.URL))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(requests).To(Equal(2))
+			Expect(buffer.String()).To(ContainSubstring("the server returned an HTML page instead of the agent package"))
+		})
+
+		It("accepts a package matching agentsha256", func() {
+			content := agentZip()
+			sum := sha256.Sum256(content)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentsha256":"%s"}`, server.URL, hex.EncodeToString(sum[:])))
+
+			Expect(supplier.Run()).To(Succeed())
+		})
+
+		It("rejects a package not matching agentsha256", func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(agentZip())
+			}))
+			bindService(fmt.Sprintf(`{"customoneagenturl":"%s","paastoken":"token","agentsha256":"%064d"}`, server.URL, 0))
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("the agent package does not match agentsha256")))
+			Expect(buffer.String()).NotTo(ContainSubstring("Download attempt 2"))
+			entries, err := filepath.Glob(filepath.Join(stager.cacheDir, "dynatrace", "*", "*.zip*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
 	})
-	// TODO: Add tests here to check install dependency functions work
 })
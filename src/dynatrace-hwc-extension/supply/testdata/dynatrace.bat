@@ -0,0 +1,13 @@
+set "COR_ENABLE_PROFILING=1"
+set "COR_PROFILER={B7038F67-52FC-4DA2-AB02-969B3C1EDA03}"
+set "CORECLR_ENABLE_PROFILING=1"
+set "CORECLR_PROFILER={B7038F67-52FC-4DA2-AB02-969B3C1EDA03}"
+set "DT_AGENTACTIVE=true"
+set "DT_BLOCKLIST=powershell*;report gen*"
+set "DT_NETWORK_ZONE=emea&prod"
+set "DT_CONNECTION_POINT=https://ag:9999/communication;https://ag2:9999/communication"
+set "DT_RUN_HINT=%%TEMP%%\a "b" | c"
+set "COR_PROFILER_PATH_32=%DEPS_DIR%\0\dynatrace\agent\lib\oneagentloader.dll"
+set "COR_PROFILER_PATH_64=%DEPS_DIR%\0\dynatrace\agent\lib64\oneagentloader.dll"
+set "CORECLR_PROFILER_PATH_32=%DEPS_DIR%\0\dynatrace\agent\lib\oneagentloader.dll"
+set "CORECLR_PROFILER_PATH_64=%DEPS_DIR%\0\dynatrace\agent\lib64\oneagentloader.dll"
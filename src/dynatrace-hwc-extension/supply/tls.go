@@ -0,0 +1,82 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Builds the TLS configuration used to talk to Dynatrace. Server certificates are verified against the system roots plus the
+// CA bundle given inline with cacert or as a file of the app with cacertfile. Verification is only disabled when the service
+// explicitly sets insecure to true.
+func newTLSConfig(s *Supplier, creds *credentials) (*tls.Config, error) {
+	if creds.Insecure {
+		s.Log.Warning("TLS certificate verification is DISABLED because insecure is set in the Dynatrace service. " +
+			"The PaaS token and the agent download can be intercepted, use cacert or cacertfile instead.")
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	if creds.CACert == "" && creds.CACertFile == "" {
+		return &tls.Config{}, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		s.Log.Info("System certificates are not available, only the CA bundle of the Dynatrace service is trusted")
+		pool = x509.NewCertPool()
+	}
+
+	if creds.CACert != "" {
+		if !pool.AppendCertsFromPEM([]byte(creds.CACert)) {
+			return nil, errors.New("cacert of the Dynatrace service does not contain any PEM encoded certificate")
+		}
+		s.Log.Info("Trusting the CA bundle from cacert")
+	}
+
+	if creds.CACertFile != "" {
+		caFile := creds.CACertFile
+		if !filepath.IsAbs(caFile) {
+			caFile = filepath.Join(s.Stager.BuildDir(), caFile)
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cacertfile %s: %s", creds.CACertFile, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cacertfile %s does not contain any PEM encoded certificate", creds.CACertFile)
+		}
+		s.Log.Info("Trusting the CA bundle from %s", creds.CACertFile)
+	}
+
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Reports whether err was caused by a server certificate that could not be verified.
+func isCertificateError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "x509: ")
+}
+
+// Adds what to do about an untrusted server certificate to err.
+func certificateError(err error) error {
+	return fmt.Errorf("%s (the server certificate is not trusted, add its CA with cacert or cacertfile to the Dynatrace service)", err)
+}
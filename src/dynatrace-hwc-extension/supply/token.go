@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Dynatrace LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supply
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// scopes the buildpack needs, InstallerDownload for the paastoken and events.ingest for the deployment event
+const (
+	installerDownloadScope = "InstallerDownload"
+	eventsIngestScope      = "events.ingest"
+)
+
+// tokenInfo is the metadata returned by the token lookup of the v2 API, or of the v1 API of older Managed clusters.
+type tokenInfo struct {
+	Enabled        *bool    `json:"enabled"`        // v2
+	ExpirationDate string   `json:"expirationDate"` // v2, ISO 8601
+	Revoked        bool     `json:"revoked"`        // v1
+	Expires        *int64   `json:"expires"`        // v1, milliseconds since the epoch
+	Scopes         []string `json:"scopes"`
+}
+
+// Looks up the metadata of token, authenticated with the token itself.
+func lookupToken(s *Supplier, creds *credentials, token string) (*tokenInfo, error) {
+	var info tokenInfo
+	body := map[string]string{"token": token}
+	err := callAPI(s, creds, http.MethodPost, apiBaseURL(creds)+"/v2/apiTokens/lookup", token, body, &info)
+	if apiErr, ok := err.(*downloadError); ok && apiErr.StatusCode == http.StatusNotFound {
+		info = tokenInfo{}
+		err = callAPI(s, creds, http.MethodPost, apiBaseURL(creds)+"/v1/tokens/lookup", token, body, &info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Returns why the token can't be used for scope, or an empty string when it can.
+func (t *tokenInfo) problem(scope string, now time.Time) string {
+	if t.Revoked || (t.Enabled != nil && !*t.Enabled) {
+		return "is revoked"
+	}
+	if t.ExpirationDate != "" {
+		if expiration, err := time.Parse(time.RFC3339, t.ExpirationDate); err == nil && expiration.Before(now) {
+			return "expired on " + expiration.Format("2006-01-02")
+		}
+	}
+	if t.Expires != nil && *t.Expires > 0 {
+		if expiration := time.Unix(0, *t.Expires*int64(time.Millisecond)); expiration.Before(now) {
+			return "expired on " + expiration.Format("2006-01-02")
+		}
+	}
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return ""
+		}
+	}
+	return "is missing the " + scope + " scope"
+}
+
+// Checks the tokens of the credentials before anything is downloaded. A paastoken that is invalid, revoked, expired or
+// missing the InstallerDownload scope fails the installation. An apitoken that can't send the deployment event is only
+// reported. When the lookup itself is not possible, e.g. because of an older cluster, the download goes ahead.
+func validateTokens(s *Supplier, creds *credentials) error {
+	if creds.CustomOneAgentURL != "" {
+		return nil
+	}
+
+	paasToken := credentialName(creds, "paastoken")
+	info, err := lookupToken(s, creds, creds.PaasToken)
+	if apiErr, ok := err.(*downloadError); ok && apiErr.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%s is not a valid token of the Dynatrace environment %s, check %s", paasToken, apiBaseURL(creds), paasToken)
+	}
+	if err != nil {
+		s.Log.Info("Unable to validate %s, continuing without the check: %s", paasToken, err)
+		return nil
+	}
+	if problem := info.problem(installerDownloadScope, time.Now()); problem != "" {
+		return fmt.Errorf("%s %s, fix %s", paasToken, problem, paasToken)
+	}
+	s.Log.Info("%s has the %s scope", paasToken, installerDownloadScope)
+
+	if !creds.DeploymentEvent || creds.APIToken == "" {
+		return nil
+	}
+	apiToken := credentialName(creds, "apitoken")
+	if info, err := lookupToken(s, creds, creds.APIToken); err != nil {
+		s.Log.Warning("Unable to validate %s, the deployment event may not be sent: %s", apiToken, err)
+	} else if problem := info.problem(eventsIngestScope, time.Now()); problem != "" {
+		s.Log.Warning("%s %s, the deployment event will not be sent until %s is fixed", apiToken, problem, apiToken)
+	}
+	return nil
+}